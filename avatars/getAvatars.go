@@ -1,29 +1,30 @@
 package avatars
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"github.com/MrWaggel/gosteamconv"
 	"io/ioutil"
 	"net/http"
 )
 
+// ErrNoAvatar is returned when the profile has no avatar link, asking again doesn't help
+var ErrNoAvatar = errors.New("no avatar")
+
 type Profile struct {
 	XMLName    xml.Name `xml:"profile"`
 	AvatarIcon string   `xml:"avatarIcon"`
 }
 
-func GetAvatar(id uint32) (string, error) {
-	steamString, err := gosteamconv.SteamInt32ToString(int32(id))
+// GetAvatar returns the hash of the Steam avatar of the user with the SteamID64
+func GetAvatar(ctx context.Context, steamID64 int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("https://steamcommunity.com/profiles/%d/?xml=1", steamID64), nil)
 	if err != nil {
 		return "", err
 	}
-	steamID64, err := gosteamconv.SteamStringToInt64(steamString)
-	if err != nil {
-		return "", err
-	}
-
-	res, err := http.Get(fmt.Sprintf("https://steamcommunity.com/profiles/%d/?xml=1", steamID64))
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -41,7 +42,7 @@ func GetAvatar(id uint32) (string, error) {
 	}
 
 	if len(profile.AvatarIcon) < 45 {
-		return "", fmt.Errorf("wrong link: %s for user: %d", profile.AvatarIcon, id)
+		return "", fmt.Errorf("%w, wrong link: %s for user: %d", ErrNoAvatar, profile.AvatarIcon, steamID64)
 	}
 	hash := profile.AvatarIcon[len(profile.AvatarIcon)-44:]
 
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/j0y/insurgency-parser/dbp"
+	"log"
+	"os"
+	"time"
+)
+
+// chatCommand prints the newest chat messages matching the flags, for investigating reports of abuse
+func chatCommand(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("chat", flag.ExitOnError)
+	player := flags.String("player", "", "SteamID of the player who wrote the messages, STEAM_X:Y:Z, [U:1:Z] or SteamID64")
+	matchID := flags.Uint("match", 0, "id of the match the messages were written in")
+	text := flags.String("text", "", "text the messages contain, case is ignored")
+	limit := flags.Int("limit", 100, "the most messages printed, 0 prints all of them")
+	printJSON := flags.Bool("json", false, "print the messages as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: chat [flags]\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	filter := dbp.ChatFilter{MatchID: uint32(*matchID), Text: *text, Limit: *limit}
+	if len(*player) > 0 {
+		var err error
+		filter.UserID, err = userIDFromSteamID(*player)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	messages, err := store.SearchChat(ctx, filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *printJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(messages)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	for _, message := range messages {
+		m := message.Message
+		say := "say"
+		if m.TeamOnly {
+			say = "say_team"
+		}
+		fmt.Printf("%s match %d %s <%s> %s %s: %s\n", time.Unix(int64(m.Time), 0).UTC().Format("2006-01-02 15:04:05"),
+			message.MatchID, m.Name, m.SteamID, m.Team, say, m.Text)
+	}
+}
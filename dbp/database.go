@@ -1,5 +1,193 @@
 package dbp
 
-import "database/sql"
+import (
+	"context"
+	"errors"
+	"github.com/j0y/insurgency-parser/parser"
+)
 
-var DB *sql.DB
+// ErrNotFound is returned when a requested row doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// Store persists parsed matches and everything derived from them
+type Store interface {
+	// InTx runs fn in a transaction which is committed when fn returns nil and rolled back otherwise
+	InTx(ctx context.Context, fn func(tx Store) error) error
+
+	// GetOrCreateMatchID finds the match by ip, start time and map, creates it if needed
+	// and updates its rounds, duration, result and mode
+	GetOrCreateMatchID(ctx context.Context, matchInfo parser.MatchInfo) (uint32, error)
+	// CheckOrCreateUser creates the user if it doesn't exist yet
+	CheckOrCreateUser(ctx context.Context, userID int64, name string) error
+	// SaveUserName adds the name to the name history of the user, widening the time it was seen,
+	// and makes it the user name when no other name was seen later
+	SaveUserName(ctx context.Context, name UserName) error
+	// UserNames returns the name history of the user, the most recently seen name first
+	UserNames(ctx context.Context, userID int64) ([]UserName, error)
+	// InsertUserStats saves the stats of a user in a match, replacing older ones,
+	// and updates the user totals by the difference
+	InsertUserStats(ctx context.Context, matchID uint32, userID int64, stats parser.PlayerStats) error
+	// RebuildUserAggregates recomputes users totals from all match stats
+	RebuildUserAggregates(ctx context.Context) error
+	// SaveRound creates or replaces the round of a match by its number
+	SaveRound(ctx context.Context, matchID uint32, round RoundStats) error
+	// SaveKills adds kills to the match, kills already saved with the same Seq are kept
+	SaveKills(ctx context.Context, matchID uint32, kills []KillEvent) error
+	// SaveSession creates or updates the session of a user in a match by its join time
+	SaveSession(ctx context.Context, matchID uint32, session Session) error
+	// SaveChat adds chat messages to the match, messages already saved with the same Seq are kept
+	SaveChat(ctx context.Context, matchID uint32, messages []ChatMessage) error
+	// SearchChat returns the newest chat messages matching the filter
+	SearchChat(ctx context.Context, filter ChatFilter) ([]ChatMessage, error)
+
+	// UsersByWeaponKills returns users without the medal who made at least min kills with the weapons,
+	// kills with a weapon listed twice count twice
+	UsersByWeaponKills(ctx context.Context, medal int, weapons []string, min uint32) ([]int64, error)
+	// UsersByObjective returns users without the medal who did the objective at least min times
+	UsersByObjective(ctx context.Context, medal int, objective Objective, min uint32) ([]int64, error)
+	// UsersByWins returns users without the medal who won at least min matches
+	UsersByWins(ctx context.Context, medal int, min uint32) ([]int64, error)
+	// DeathlessWins returns the most kills every user made in a won match without dying,
+	// only matches with more than minKills kills are counted
+	DeathlessWins(ctx context.Context, minKills uint32) ([]UserValue, error)
+	// MedalValue returns the value of an awarded medal or ErrNotFound
+	MedalValue(ctx context.Context, userID int64, medal int) (uint32, error)
+	// AwardMedal gives the medal to the user
+	AwardMedal(ctx context.Context, userID int64, medal int) error
+	// SetMedalValue gives the medal to the user or updates the value of an awarded one
+	SetMedalValue(ctx context.Context, userID int64, medal int, value uint32) error
+
+	// IngestedFile returns the ledger entry of a log file or ErrNotFound
+	IngestedFile(ctx context.Context, path string) (IngestedFile, error)
+	// ParsedFileByHash returns a parsed log file with the same content or ErrNotFound
+	ParsedFileByHash(ctx context.Context, hash string) (IngestedFile, error)
+	// SaveIngestedFile creates or updates the ledger entry of the file
+	SaveIngestedFile(ctx context.Context, file IngestedFile) error
+
+	// UsersWithoutAvatar returns users which avatar wasn't fetched yet
+	UsersWithoutAvatar(ctx context.Context) ([]int64, error)
+	SetAvatar(ctx context.Context, userID int64, hash string) error
+
+	Close() error
+}
+
+// BulkLoader is implemented by stores which can load many parsed files at once
+// faster than writing every match in its own transaction
+type BulkLoader interface {
+	// BulkLoad writes the matches and ledger entries of all files in one transaction,
+	// MatchID of the entries is set to the last match of the file
+	BulkLoad(ctx context.Context, files []BulkFile) error
+}
+
+// BulkFile is a parsed log for BulkLoad
+type BulkFile struct {
+	Ingested IngestedFile
+	Matches  []MatchStats
+	// LastMatch identifies the match the file ends with, it's empty when no map was loaded
+	LastMatch parser.MatchInfo
+}
+
+// MatchStats is a parsed match with player stats keyed by user id
+type MatchStats struct {
+	Match    parser.MatchInfo
+	Players  map[int64]parser.PlayerStats
+	Rounds   []RoundStats
+	Kills    []KillEvent
+	Sessions []Session
+	Chat     []ChatMessage
+	Names    []UserName
+}
+
+// RoundStats is a round of a match with player stats keyed by user id
+type RoundStats struct {
+	Round   parser.RoundInfo
+	Players map[int64]parser.RoundPlayerStats
+}
+
+// KillEvent is a kill with the user ids of the players, which are 0 for bots
+type KillEvent struct {
+	Kill       parser.KillEvent
+	AttackerID int64
+	VictimID   int64
+}
+
+// Session is a session of a user in a match
+type Session struct {
+	Session parser.Session
+	UserID  int64
+}
+
+// ChatMessage is a chat message with the user id of the player, which is 0 for the console
+type ChatMessage struct {
+	Message parser.ChatMessage `json:"message"`
+	UserID  int64              `json:"user_id"`
+	// MatchID is set by SearchChat
+	MatchID uint32 `json:"match_id"`
+}
+
+// UserName is a name a user played with
+type UserName struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name"`
+	// FirstSeen and LastSeen are 0 for names from before the history was recorded
+	FirstSeen uint64 `json:"first_seen"`
+	LastSeen  uint64 `json:"last_seen"`
+}
+
+// ChatFilter selects chat messages, zero fields match every message
+type ChatFilter struct {
+	UserID  int64
+	MatchID uint32
+	// Text is searched in the messages ignoring case
+	Text string
+	// Limit is the most messages returned, 0 returns all of them
+	Limit int
+}
+
+// Objective is one of the objective stats of users
+type Objective string
+
+const (
+	ObjectiveCaptures        Objective = "captures"
+	ObjectiveCachesDestroyed Objective = "caches_destroyed"
+	ObjectiveDefends         Objective = "defends"
+)
+
+type UserValue struct {
+	ID    int64  `json:"id"`
+	Value uint32 `json:"value"`
+}
+
+const (
+	// FileStatusParsing the match in the file is not over yet, it's parsed again when the file grows
+	FileStatusParsing = "parsing"
+	// FileStatusParsed the match is over and stored, the file is not read again
+	FileStatusParsed = "parsed"
+	// FileStatusSkipped the file has no map loaded
+	FileStatusSkipped = "skipped"
+	// FileStatusFailed see Error, the file is parsed again on the next pass
+	FileStatusFailed = "failed"
+	// FileStatusQuarantined parsing the file fails the same way every time, see Error.
+	// It's parsed again when it changes or the parser version is updated.
+	FileStatusQuarantined = "quarantined"
+)
+
+// IngestedFile is the ledger entry of a log file
+type IngestedFile struct {
+	Path string `json:"path"`
+	// Size of the file when it was read
+	Size int64 `json:"size"`
+	// Hash is the hex encoded SHA-256 of the first Offset bytes
+	Hash string `json:"hash"`
+	// Offset is the number of bytes parsed
+	Offset int64 `json:"offset"`
+	// MatchID of the last match in the file, 0 when there is none
+	MatchID       uint32 `json:"match_id"`
+	Status        string `json:"status"`
+	ParserVersion int    `json:"parser_version"`
+	Error         string `json:"error"`
+	// State is what is needed to continue parsing from Offset, empty when the file doesn't have to be parsed again
+	State      []byte `json:"state"`
+	InsertedAt int64  `json:"inserted_at"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
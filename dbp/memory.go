@@ -0,0 +1,701 @@
+package dbp
+
+import (
+	"context"
+	"fmt"
+	"github.com/j0y/insurgency-parser/parser"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Store keeping everything in process memory, useful for tests and dry runs
+type Memory struct {
+	*memoryState
+	// journal is set for the store of a transaction
+	journal *memoryJournal
+}
+
+// memoryState is shared by a Memory and the stores of its transactions
+type memoryState struct {
+	// txMu is held by the running transaction, calls outside of it wait
+	txMu        sync.Mutex
+	mu          sync.Mutex
+	nextMatchID uint32
+	matches     map[uint32]*parser.MatchInfo
+	users       map[int64]*memoryUser
+	stats       map[memoryStatsKey]parser.PlayerStats
+	medals      map[memoryMedalKey]uint32
+	rounds      map[memoryRoundKey]RoundStats
+	kills       map[memoryKillKey]KillEvent
+	sessions    map[memorySessionKey]Session
+	chat        map[memoryKillKey]ChatMessage
+	names       map[memoryNameKey]UserName
+	files       map[string]IngestedFile
+}
+
+type memoryUser struct {
+	Name              string
+	AvatarHash        string
+	Kills             uint32
+	Deaths            uint32
+	PvPKills          uint32
+	PvPDeaths         uint32
+	Playtime          uint32
+	Captures          uint32
+	CachesDestroyed   uint32
+	Defends           uint32
+	Fratricide        uint32
+	Suicides          uint32
+	EnvironmentDeaths uint32
+	KD                float64
+	AllWeaponStats    parser.WeaponStats
+	// AllDeathWeaponStats sums DeathWeaponStats of all matches
+	AllDeathWeaponStats parser.WeaponStats
+}
+
+type memoryStatsKey struct {
+	MatchID uint32
+	UserID  int64
+}
+
+type memoryRoundKey struct {
+	MatchID uint32
+	Number  uint8
+}
+
+// memoryKillKey is the key of kills and chat messages
+type memoryKillKey struct {
+	MatchID uint32
+	Seq     uint32
+}
+
+type memorySessionKey struct {
+	MatchID  uint32
+	UserID   int64
+	JoinedAt uint64
+}
+
+type memoryNameKey struct {
+	UserID int64
+	Name   string
+}
+
+type memoryMedalKey struct {
+	UserID int64
+	Medal  int
+}
+
+// memoryJournal undoes the writes of a transaction in reverse order when it's rolled back
+type memoryJournal struct {
+	undo []func()
+}
+
+func NewMemory() *Memory {
+	return &Memory{memoryState: &memoryState{
+		matches:  make(map[uint32]*parser.MatchInfo),
+		users:    make(map[int64]*memoryUser),
+		stats:    make(map[memoryStatsKey]parser.PlayerStats),
+		medals:   make(map[memoryMedalKey]uint32),
+		rounds:   make(map[memoryRoundKey]RoundStats),
+		kills:    make(map[memoryKillKey]KillEvent),
+		sessions: make(map[memorySessionKey]Session),
+		chat:     make(map[memoryKillKey]ChatMessage),
+		names:    make(map[memoryNameKey]UserName),
+		files:    make(map[string]IngestedFile),
+	}}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// InTx undoes the writes of fn when it fails or ctx is done before it returns.
+// Calls outside of the transaction wait until it's over.
+func (m *Memory) InTx(ctx context.Context, fn func(tx Store) error) error {
+	if m.journal != nil {
+		// already in a transaction
+		return fn(m)
+	}
+
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tx := &Memory{memoryState: m.memoryState, journal: &memoryJournal{}}
+	err := fn(tx)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		m.mu.Lock()
+		for i := len(tx.journal.undo) - 1; i >= 0; i-- {
+			tx.journal.undo[i]()
+		}
+		m.mu.Unlock()
+	}
+
+	return err
+}
+
+// lock waits for the running transaction unless m is its store
+func (m *Memory) lock() {
+	if m.journal == nil {
+		m.txMu.Lock()
+	}
+	m.mu.Lock()
+}
+
+func (m *Memory) unlock() {
+	m.mu.Unlock()
+	if m.journal == nil {
+		m.txMu.Unlock()
+	}
+}
+
+// remember journals the value of key so it's restored on rollback, values must not be changed in place
+func remember[K comparable, V any](journal *memoryJournal, values map[K]V, key K) {
+	if journal == nil {
+		return
+	}
+
+	old, ok := values[key]
+	journal.undo = append(journal.undo, func() {
+		if ok {
+			values[key] = old
+		} else {
+			delete(values, key)
+		}
+	})
+}
+
+// rememberUser journals a copy of the user, which is changed in place
+func (m *Memory) rememberUser(id int64) {
+	user, ok := m.users[id]
+	if m.journal == nil || !ok {
+		remember(m.journal, m.users, id)
+		return
+	}
+
+	userCopy := *user
+	userCopy.AllWeaponStats = copyWeaponStats(user.AllWeaponStats)
+	userCopy.AllDeathWeaponStats = copyWeaponStats(user.AllDeathWeaponStats)
+	m.journal.undo = append(m.journal.undo, func() { m.users[id] = &userCopy })
+}
+
+func (m *Memory) GetOrCreateMatchID(ctx context.Context, matchInfo parser.MatchInfo) (uint32, error) {
+	m.lock()
+	defer m.unlock()
+
+	for id, match := range m.matches {
+		if match.Ip == matchInfo.Ip && match.StartedAt == matchInfo.StartedAt && match.Map == matchInfo.Map {
+			if m.journal != nil {
+				matchCopy := *match
+				m.journal.undo = append(m.journal.undo, func() { *match = matchCopy })
+			}
+			match.Rounds = matchInfo.Rounds
+			match.Duration = matchInfo.Duration
+			match.Won = matchInfo.Won
+			match.Mode = matchInfo.Mode
+			return id, nil
+		}
+	}
+
+	if m.journal != nil {
+		nextMatchID := m.nextMatchID
+		m.journal.undo = append(m.journal.undo, func() { m.nextMatchID = nextMatchID })
+	}
+	m.nextMatchID++
+	remember(m.journal, m.matches, m.nextMatchID)
+	match := matchInfo
+	m.matches[m.nextMatchID] = &match
+
+	return m.nextMatchID, nil
+}
+
+func (m *Memory) CheckOrCreateUser(ctx context.Context, userID int64, name string) error {
+	m.lock()
+	defer m.unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		remember(m.journal, m.users, userID)
+		m.users[userID] = &memoryUser{Name: name, AllWeaponStats: make(parser.WeaponStats),
+			AllDeathWeaponStats: make(parser.WeaponStats)}
+	}
+
+	return nil
+}
+
+func (m *Memory) SaveUserName(ctx context.Context, name UserName) error {
+	m.lock()
+	defer m.unlock()
+
+	key := memoryNameKey{UserID: name.UserID, Name: name.Name}
+	if saved, ok := m.names[key]; ok {
+		if saved.FirstSeen != 0 && saved.FirstSeen < name.FirstSeen {
+			name.FirstSeen = saved.FirstSeen
+		}
+		if saved.LastSeen > name.LastSeen {
+			name.LastSeen = saved.LastSeen
+		}
+	}
+	remember(m.journal, m.names, key)
+	m.names[key] = name
+
+	user, ok := m.users[name.UserID]
+	if !ok {
+		return nil
+	}
+	for _, other := range m.names {
+		if other.UserID == name.UserID && other.LastSeen > name.LastSeen {
+			return nil
+		}
+	}
+	m.rememberUser(name.UserID)
+	user.Name = name.Name
+
+	return nil
+}
+
+func (m *Memory) UserNames(ctx context.Context, userID int64) ([]UserName, error) {
+	m.lock()
+	defer m.unlock()
+
+	names := make([]UserName, 0)
+	for _, name := range m.names {
+		if name.UserID == userID {
+			names = append(names, name)
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		if a.LastSeen != b.LastSeen {
+			return a.LastSeen > b.LastSeen
+		}
+		if a.FirstSeen != b.FirstSeen {
+			return a.FirstSeen > b.FirstSeen
+		}
+		return a.Name < b.Name
+	})
+
+	return names, nil
+}
+
+func (m *Memory) InsertUserStats(ctx context.Context, matchID uint32, userID int64, stats parser.PlayerStats) error {
+	m.lock()
+	defer m.unlock()
+
+	stats.WeaponStats = copyWeaponStats(stats.WeaponStats)
+	stats.DeathWeaponStats = copyWeaponStats(stats.DeathWeaponStats)
+
+	key := memoryStatsKey{MatchID: matchID, UserID: userID}
+	old := m.stats[key]
+	remember(m.journal, m.stats, key)
+	m.stats[key] = stats
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil
+	}
+	m.rememberUser(userID)
+	user.Kills += stats.Kills - old.Kills
+	user.Deaths += stats.Deaths - old.Deaths
+	user.PvPKills += stats.PvPKills - old.PvPKills
+	user.PvPDeaths += stats.PvPDeaths - old.PvPDeaths
+	user.Playtime += stats.Playtime - old.Playtime
+	user.Captures += stats.Captures - old.Captures
+	user.CachesDestroyed += stats.CachesDestroyed - old.CachesDestroyed
+	user.Defends += stats.Defends - old.Defends
+	user.Fratricide += stats.Fratricide - old.Fratricide
+	user.Suicides += stats.Suicides - old.Suicides
+	user.EnvironmentDeaths += stats.EnvironmentDeaths - old.EnvironmentDeaths
+	addWeaponStats(user.AllWeaponStats, stats.WeaponStats, old.WeaponStats)
+	addWeaponStats(user.AllDeathWeaponStats, stats.DeathWeaponStats, old.DeathWeaponStats)
+	user.updateKD()
+
+	return nil
+}
+
+func copyWeaponStats(stats parser.WeaponStats) parser.WeaponStats {
+	statsCopy := make(parser.WeaponStats, len(stats))
+	for weapon, kills := range stats {
+		statsCopy[weapon] = kills
+	}
+
+	return statsCopy
+}
+
+// addWeaponStats adds the difference of stats to old to total
+func addWeaponStats(total, stats, old parser.WeaponStats) {
+	for weapon, kills := range stats {
+		total[weapon] += kills
+	}
+	for weapon, kills := range old {
+		total[weapon] -= kills
+		if total[weapon] == 0 {
+			delete(total, weapon)
+		}
+	}
+}
+
+func (u *memoryUser) updateKD() {
+	if u.Kills > 100 {
+		if u.Deaths != 0 {
+			u.KD = float64(u.Kills) / float64(u.Deaths)
+		} else {
+			u.KD = 9999
+		}
+	}
+}
+
+func (m *Memory) RebuildUserAggregates(ctx context.Context) error {
+	m.lock()
+	defer m.unlock()
+
+	totals := make(map[int64]*memoryUser)
+	for key, stats := range m.stats {
+		total, ok := totals[key.UserID]
+		if !ok {
+			total = &memoryUser{AllWeaponStats: make(parser.WeaponStats), AllDeathWeaponStats: make(parser.WeaponStats)}
+			totals[key.UserID] = total
+		}
+		total.Kills += stats.Kills
+		total.Deaths += stats.Deaths
+		total.PvPKills += stats.PvPKills
+		total.PvPDeaths += stats.PvPDeaths
+		total.Playtime += stats.Playtime
+		total.Captures += stats.Captures
+		total.CachesDestroyed += stats.CachesDestroyed
+		total.Defends += stats.Defends
+		total.Fratricide += stats.Fratricide
+		total.Suicides += stats.Suicides
+		total.EnvironmentDeaths += stats.EnvironmentDeaths
+		addWeaponStats(total.AllWeaponStats, stats.WeaponStats, nil)
+		addWeaponStats(total.AllDeathWeaponStats, stats.DeathWeaponStats, nil)
+	}
+
+	for id, total := range totals {
+		user, ok := m.users[id]
+		if !ok {
+			continue
+		}
+		m.rememberUser(id)
+		user.Kills = total.Kills
+		user.Deaths = total.Deaths
+		user.PvPKills = total.PvPKills
+		user.PvPDeaths = total.PvPDeaths
+		user.Playtime = total.Playtime
+		user.Captures = total.Captures
+		user.CachesDestroyed = total.CachesDestroyed
+		user.Defends = total.Defends
+		user.Fratricide = total.Fratricide
+		user.Suicides = total.Suicides
+		user.EnvironmentDeaths = total.EnvironmentDeaths
+		user.AllWeaponStats = total.AllWeaponStats
+		user.AllDeathWeaponStats = total.AllDeathWeaponStats
+		user.updateKD()
+	}
+
+	return nil
+}
+
+func (m *Memory) SaveRound(ctx context.Context, matchID uint32, round RoundStats) error {
+	m.lock()
+	defer m.unlock()
+
+	players := make(map[int64]parser.RoundPlayerStats, len(round.Players))
+	for userID, stats := range round.Players {
+		players[userID] = stats
+	}
+	round.Players = players
+
+	key := memoryRoundKey{MatchID: matchID, Number: round.Round.Number}
+	remember(m.journal, m.rounds, key)
+	m.rounds[key] = round
+
+	return nil
+}
+
+func (m *Memory) SaveKills(ctx context.Context, matchID uint32, kills []KillEvent) error {
+	m.lock()
+	defer m.unlock()
+
+	for _, kill := range kills {
+		key := memoryKillKey{MatchID: matchID, Seq: kill.Kill.Seq}
+		if _, ok := m.kills[key]; !ok {
+			remember(m.journal, m.kills, key)
+			m.kills[key] = kill
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) SaveSession(ctx context.Context, matchID uint32, session Session) error {
+	m.lock()
+	defer m.unlock()
+
+	key := memorySessionKey{MatchID: matchID, UserID: session.UserID, JoinedAt: session.Session.JoinedAt}
+	remember(m.journal, m.sessions, key)
+	m.sessions[key] = session
+
+	return nil
+}
+
+func (m *Memory) SaveChat(ctx context.Context, matchID uint32, messages []ChatMessage) error {
+	m.lock()
+	defer m.unlock()
+
+	for _, message := range messages {
+		key := memoryKillKey{MatchID: matchID, Seq: message.Message.Seq}
+		if _, ok := m.chat[key]; !ok {
+			message.MatchID = matchID
+			remember(m.journal, m.chat, key)
+			m.chat[key] = message
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) SearchChat(ctx context.Context, filter ChatFilter) ([]ChatMessage, error) {
+	m.lock()
+	defer m.unlock()
+
+	text := strings.ToLower(filter.Text)
+	messages := make([]ChatMessage, 0)
+	for _, message := range m.chat {
+		if (filter.UserID != 0 && message.UserID != filter.UserID) ||
+			(filter.MatchID != 0 && message.MatchID != filter.MatchID) ||
+			!strings.Contains(strings.ToLower(message.Message.Text), text) {
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		if a.Message.Time != b.Message.Time {
+			return a.Message.Time > b.Message.Time
+		}
+		if a.MatchID != b.MatchID {
+			return a.MatchID > b.MatchID
+		}
+		return a.Message.Seq > b.Message.Seq
+	})
+	if filter.Limit > 0 && len(messages) > filter.Limit {
+		messages = messages[:filter.Limit]
+	}
+
+	return messages, nil
+}
+
+func (m *Memory) UsersByObjective(ctx context.Context, medal int, objective Objective, min uint32) ([]int64, error) {
+	m.lock()
+	defer m.unlock()
+
+	ids := make([]int64, 0)
+	for id, user := range m.users {
+		if _, ok := m.medals[memoryMedalKey{UserID: id, Medal: medal}]; ok {
+			continue
+		}
+
+		var value uint32
+		switch objective {
+		case ObjectiveCaptures:
+			value = user.Captures
+		case ObjectiveCachesDestroyed:
+			value = user.CachesDestroyed
+		case ObjectiveDefends:
+			value = user.Defends
+		default:
+			return nil, fmt.Errorf("unknown objective %q", objective)
+		}
+		if value >= min {
+			ids = append(ids, id)
+		}
+	}
+
+	return sortIDs(ids), nil
+}
+
+func (m *Memory) UsersByWeaponKills(ctx context.Context, medal int, weapons []string, min uint32) ([]int64, error) {
+	m.lock()
+	defer m.unlock()
+
+	ids := make([]int64, 0)
+	for id, user := range m.users {
+		if _, ok := m.medals[memoryMedalKey{UserID: id, Medal: medal}]; ok {
+			continue
+		}
+
+		var kills uint32
+		for _, weapon := range weapons {
+			kills += user.AllWeaponStats[weapon]
+		}
+		if kills >= min {
+			ids = append(ids, id)
+		}
+	}
+
+	return sortIDs(ids), nil
+}
+
+func (m *Memory) UsersByWins(ctx context.Context, medal int, min uint32) ([]int64, error) {
+	m.lock()
+	defer m.unlock()
+
+	wins := make(map[int64]uint32)
+	for key := range m.stats {
+		if match, ok := m.matches[key.MatchID]; ok && match.Won {
+			wins[key.UserID]++
+		}
+	}
+
+	ids := make([]int64, 0)
+	for id, count := range wins {
+		if _, ok := m.medals[memoryMedalKey{UserID: id, Medal: medal}]; ok {
+			continue
+		}
+		if count >= min {
+			ids = append(ids, id)
+		}
+	}
+
+	return sortIDs(ids), nil
+}
+
+func (m *Memory) DeathlessWins(ctx context.Context, minKills uint32) ([]UserValue, error) {
+	m.lock()
+	defer m.unlock()
+
+	maxKills := make(map[int64]uint32)
+	for key, stats := range m.stats {
+		match, ok := m.matches[key.MatchID]
+		if !ok || !match.Won || stats.Deaths != 0 || stats.Kills <= minKills {
+			continue
+		}
+		if stats.Kills > maxKills[key.UserID] {
+			maxKills[key.UserID] = stats.Kills
+		}
+	}
+
+	userStats := make([]UserValue, 0, len(maxKills))
+	for id, kills := range maxKills {
+		userStats = append(userStats, UserValue{ID: id, Value: kills})
+	}
+	sort.Slice(userStats, func(i, j int) bool { return userStats[i].ID < userStats[j].ID })
+
+	return userStats, nil
+}
+
+func (m *Memory) MedalValue(ctx context.Context, userID int64, medal int) (uint32, error) {
+	m.lock()
+	defer m.unlock()
+
+	value, ok := m.medals[memoryMedalKey{UserID: userID, Medal: medal}]
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	return value, nil
+}
+
+func (m *Memory) AwardMedal(ctx context.Context, userID int64, medal int) error {
+	m.lock()
+	defer m.unlock()
+
+	key := memoryMedalKey{UserID: userID, Medal: medal}
+	remember(m.journal, m.medals, key)
+	m.medals[key] = 0
+
+	return nil
+}
+
+func (m *Memory) SetMedalValue(ctx context.Context, userID int64, medal int, value uint32) error {
+	m.lock()
+	defer m.unlock()
+
+	key := memoryMedalKey{UserID: userID, Medal: medal}
+	remember(m.journal, m.medals, key)
+	m.medals[key] = value
+
+	return nil
+}
+
+func (m *Memory) IngestedFile(ctx context.Context, path string) (IngestedFile, error) {
+	m.lock()
+	defer m.unlock()
+
+	file, ok := m.files[path]
+	if !ok {
+		return file, ErrNotFound
+	}
+
+	return file, nil
+}
+
+func (m *Memory) ParsedFileByHash(ctx context.Context, hash string) (IngestedFile, error) {
+	m.lock()
+	defer m.unlock()
+
+	for _, file := range m.files {
+		if file.Hash == hash && file.Status == FileStatusParsed {
+			return file, nil
+		}
+	}
+
+	return IngestedFile{}, ErrNotFound
+}
+
+func (m *Memory) SaveIngestedFile(ctx context.Context, file IngestedFile) error {
+	m.lock()
+	defer m.unlock()
+
+	file.UpdatedAt = time.Now().Unix()
+	if old, ok := m.files[file.Path]; ok {
+		file.InsertedAt = old.InsertedAt
+	} else {
+		file.InsertedAt = file.UpdatedAt
+	}
+	remember(m.journal, m.files, file.Path)
+	m.files[file.Path] = file
+
+	return nil
+}
+
+func (m *Memory) UsersWithoutAvatar(ctx context.Context) ([]int64, error) {
+	m.lock()
+	defer m.unlock()
+
+	ids := make([]int64, 0)
+	for id, user := range m.users {
+		if len(user.AvatarHash) == 0 {
+			ids = append(ids, id)
+		}
+	}
+
+	return sortIDs(ids), nil
+}
+
+func (m *Memory) SetAvatar(ctx context.Context, userID int64, hash string) error {
+	m.lock()
+	defer m.unlock()
+
+	if user, ok := m.users[userID]; ok {
+		m.rememberUser(userID)
+		user.AvatarHash = hash
+	}
+
+	return nil
+}
+
+func sortIDs(ids []int64) []int64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,58 @@
+package dbp
+
+import (
+	"context"
+	"github.com/j0y/insurgency-parser/parser"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryStatsOfUnknownMatch(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	err := m.CheckOrCreateUser(ctx, 1, "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// postgres rejects stats of unknown matches with a foreign key, memory mustn't count them
+	err = m.InsertUserStats(ctx, 42, 1, parser.PlayerStats{Kills: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := m.UsersByWins(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("got users %v with wins in an unknown match", ids)
+	}
+
+	values, err := m.DeathlessWins(ctx, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Errorf("got %+v in an unknown match", values)
+	}
+}
+
+func TestMemoryUserTotals(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	writeMatches(t, ctx, m,
+		testMatch{info: testMatchInfo(1, true), players: map[int64]parser.PlayerStats{
+			1: {Name: "Alice", Kills: 60, Deaths: 2, WeaponStats: parser.WeaponStats{"akm": 50, "m67": 10},
+				DeathWeaponStats: parser.WeaponStats{"rpk": 2}},
+		}},
+		testMatch{info: testMatchInfo(2, false), players: map[int64]parser.PlayerStats{
+			1: {Name: "Alice", Kills: 50, Fratricide: 1, WeaponStats: parser.WeaponStats{"akm": 50}},
+		}},
+	)
+
+	want := memoryUser{Name: "Alice", Kills: 110, Deaths: 2, Fratricide: 1, KD: 55,
+		AllWeaponStats: parser.WeaponStats{"akm": 100, "m67": 10}, AllDeathWeaponStats: parser.WeaponStats{"rpk": 2}}
+	if user := *m.users[1]; !reflect.DeepEqual(user, want) {
+		t.Errorf("got user %+v, want %+v", user, want)
+	}
+}
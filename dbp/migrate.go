@@ -0,0 +1,221 @@
+package dbp
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is a schema change from migrations/<dialect>/<version>_<name>.up.sql,
+// the .down.sql file next to it reverts the change
+type Migration struct {
+	Version int
+	Name    string
+	// AppliedAt is the unix time the migration was applied, 0 when it's pending
+	AppliedAt int64
+
+	up, down string
+}
+
+// Migrator is implemented by stores with a versioned schema
+type Migrator interface {
+	// MigrateUp applies every pending migration in its own transaction and returns them
+	MigrateUp(ctx context.Context) ([]Migration, error)
+	// MigrateDown reverts the last steps applied migrations and returns them
+	MigrateDown(ctx context.Context, steps int) ([]Migration, error)
+	// Migrations returns the known and applied migrations ordered by version
+	Migrations(ctx context.Context) ([]Migration, error)
+}
+
+// loadMigrations reads the embedded migrations of the dialect
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		versionName := strings.SplitN(strings.TrimSuffix(name, "."+direction+".sql"), "_", 2)
+		version, err := strconv.Atoi(versionName[0])
+		if err != nil || len(versionName) != 2 {
+			return nil, fmt.Errorf("wrong migration file name: %s", name)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: versionName[1]}
+			byVersion[version] = migration
+		}
+		if direction == "up" {
+			migration.up = string(content)
+		} else {
+			migration.down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if len(migration.up) == 0 || len(migration.down) == 0 {
+			return nil, fmt.Errorf("migration %d needs both up and down files", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func (s *sqlStore) migrations(ctx context.Context, dialect string) ([]Migration, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version    integer PRIMARY KEY,
+    name       text    NOT NULL,
+    applied_at bigint  NOT NULL
+)`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var applied Migration
+		err = rows.Scan(&applied.Version, &applied.Name, &applied.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		i := sort.Search(len(migrations), func(i int) bool { return migrations[i].Version >= applied.Version })
+		if i < len(migrations) && migrations[i].Version == applied.Version {
+			migrations[i].AppliedAt = applied.AppliedAt
+			continue
+		}
+		// applied by a newer version of the program, it can't be reverted by this one
+		migrations = append(migrations[:i], append([]Migration{applied}, migrations[i:]...)...)
+	}
+
+	// get any error encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return migrations, nil
+}
+
+func (s *sqlStore) migrateUp(ctx context.Context, dialect string) ([]Migration, error) {
+	migrations, err := s.migrations(ctx, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0)
+	for _, migration := range migrations {
+		if migration.AppliedAt != 0 {
+			continue
+		}
+
+		migration.AppliedAt = time.Now().Unix()
+		err = s.runMigration(ctx, migration.up,
+			`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+			migration.Version, migration.Name, migration.AppliedAt)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+func (s *sqlStore) migrateDown(ctx context.Context, dialect string, steps int) ([]Migration, error) {
+	migrations, err := s.migrations(ctx, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	reverted := make([]Migration, 0, steps)
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		migration := migrations[i]
+		if migration.AppliedAt == 0 {
+			continue
+		}
+		if len(migration.down) == 0 {
+			return reverted, fmt.Errorf("migration %d_%s is unknown to this version", migration.Version, migration.Name)
+		}
+
+		err = s.runMigration(ctx, migration.down, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		migration.AppliedAt = 0
+		reverted = append(reverted, migration)
+	}
+
+	return reverted, nil
+}
+
+// runMigration runs the script and records it with the query in one transaction
+func (s *sqlStore) runMigration(ctx context.Context, script string, query string, args ...interface{}) error {
+	if s.conn == nil {
+		return errors.New("migrations can't run in a transaction")
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, script)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, query, args...)
+	}
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			return fmt.Errorf("%w, rollback failed: %v", err, rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
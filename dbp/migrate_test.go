@@ -0,0 +1,164 @@
+package dbp
+
+import (
+	"context"
+	"github.com/j0y/insurgency-parser/steamid"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// pendingVersions returns the versions of the migrations which aren't applied
+func pendingVersions(t *testing.T, ctx context.Context, migrator Migrator) []int {
+	t.Helper()
+	migrations, err := migrator.Migrations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := make([]int, 0)
+	for _, migration := range migrations {
+		if migration.AppliedAt == 0 {
+			pending = append(pending, migration.Version)
+		}
+	}
+
+	return pending
+}
+
+// versions returns the versions of the migrations
+func versions(migrations []Migration) []int {
+	result := make([]int, 0, len(migrations))
+	for _, migration := range migrations {
+		result = append(result, migration.Version)
+	}
+
+	return result
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	ctx := context.Background()
+	store, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	known, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := versions(known)
+	last := all[len(all)-1]
+
+	if pending := pendingVersions(t, ctx, store); !reflect.DeepEqual(pending, all) {
+		t.Errorf("got pending migrations %v of a new database, want %v", pending, all)
+	}
+
+	applied, err := store.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions(applied), all) {
+		t.Errorf("got applied migrations %v, want %v", versions(applied), all)
+	}
+	if pending := pendingVersions(t, ctx, store); len(pending) != 0 {
+		t.Errorf("got pending migrations %v after up", pending)
+	}
+	applied, err = store.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("got migrations %v applied twice", versions(applied))
+	}
+
+	reverted, err := store.MigrateDown(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions(reverted), []int{last}) {
+		t.Errorf("got reverted migrations %v, want %d", versions(reverted), last)
+	}
+	if pending := pendingVersions(t, ctx, store); !reflect.DeepEqual(pending, []int{last}) {
+		t.Errorf("got pending migrations %v after down, want %d", pending, last)
+	}
+
+	// every table is dropped and created again
+	reverted, err = store.MigrateDown(ctx, len(all))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(all)-1 {
+		t.Errorf("got reverted migrations %v, want all but %d", versions(reverted), last)
+	}
+	if _, err = store.UsersWithoutAvatar(ctx); err == nil {
+		t.Error("got users after every migration was reverted")
+	}
+	applied, err = store.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions(applied), all) {
+		t.Errorf("got applied migrations %v after down, want %v", versions(applied), all)
+	}
+	if _, err = store.UsersWithoutAvatar(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrationsOfNewerVersion(t *testing.T) {
+	ctx := context.Background()
+	store := testSQLite(t)
+
+	// applied by a newer version of the program
+	_, err := store.db.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (9999, 'newer', 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := store.Migrations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newest := migrations[len(migrations)-1]
+	if newest.Version != 9999 || newest.Name != "newer" || newest.AppliedAt != 1 {
+		t.Errorf("got the newest migration %+v, want the unknown one", newest)
+	}
+
+	reverted, err := store.MigrateDown(ctx, 1)
+	if err == nil || len(reverted) != 0 {
+		t.Errorf("got reverted %v and error %v, want the unknown migration to stop down", versions(reverted), err)
+	}
+}
+
+func TestSQLiteSteamID64Migration(t *testing.T) {
+	ctx := context.Background()
+	store := testSQLite(t)
+	_, err := store.MigrateDown(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keyed by the account id of STEAM_1:1:12345
+	_, err = store.db.ExecContext(ctx, `INSERT INTO users (id, name) VALUES (24691, 'Alice')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := steamid.Parse("STEAM_1:1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := store.UsersWithoutAvatar(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int64{want}) {
+		t.Errorf("got users %v after the migration, want the SteamID64 %d", ids, want)
+	}
+}
@@ -0,0 +1,7 @@
+drop table if exists "user_medals";
+
+drop table if exists "match_user_stats";
+
+drop table if exists "users";
+
+drop table if exists "matches";
@@ -1,4 +1,4 @@
-create table "matches"
+create table if not exists "matches"
 (
     id          integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
     ip          VARCHAR(15) NOT NULL,
@@ -9,9 +9,9 @@ create table "matches"
     won         bool        NOT NULL default false,
     inserted_at bigint      NOT NULL DEFAULT date_part('epoch'::text, now()),
     UNIQUE (ip, started_at, map)
-)
+);
 
-create table "users"
+create table if not exists "users"
 (
     id               bigint PRIMARY KEY,
     name             VARCHAR(32) NOT NULL,
@@ -22,12 +22,12 @@ create table "users"
     kd               numeric(10, 2)       DEFAULT NULL,
     all_weapon_stats jsonb       NOT NULL default '{}'::jsonb,
     inserted_at      bigint      NOT NULL DEFAULT date_part('epoch'::text, now())
-)
+);
 
-CREATE INDEX idx_users_kills
+CREATE INDEX if not exists idx_users_kills
     ON users (kills);
 
-create table "match_user_stats"
+create table if not exists "match_user_stats"
 (
     match_id     integer NOT NULL,
     user_id      bigint  NOT NULL,
@@ -39,9 +39,9 @@ create table "match_user_stats"
     FOREIGN KEY (match_id) REFERENCES matches (id) ON DELETE CASCADE ON UPDATE CASCADE,
     FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
     UNIQUE (match_id, user_id)
-)
+);
 
-create table "user_medals"
+create table if not exists "user_medals"
 (
     user_id     bigint  NOT NULL,
     medal_id    integer NOT NULL,
@@ -50,39 +50,4 @@ create table "user_medals"
 
     FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
     UNIQUE (user_id, medal_id)
-)
-
-
-update users
-set kills = a.total from (select user_id, sum(kills) as total from match_user_stats group by user_id) a
-WHERE users.id = a.user_id;
-
-update users
-set deaths = a.total from (select user_id, sum(deaths) as total from match_user_stats group by user_id) a
-WHERE users.id = a.user_id;
-
-update users
-set fratricide = a.total from (select user_id, sum(fratricide) as total from match_user_stats group by user_id) a
-WHERE users.id = a.user_id;
-
-update users
-set kd = cast(kills as decimal) / deaths
-where kills > 100
-  and deaths != 0;
-
-update users
-set kd = 9999
-where kills > 100
-  and deaths = 0
-
-update users
-set all_weapon_stats = stats.agg from (
-select user_id, jsonb_object_agg(k, val) as agg
-from (
-         select user_id, k, sum(v::numeric) as val
-         from match_user_stats
-                  join lateral jsonb_each_text(weapon_stats) j(k, v) on true
-         group by user_id, k
-     ) tt
-group by user_id) stats
-where user_id = id
+);
@@ -0,0 +1,19 @@
+create table if not exists "ingested_files"
+(
+    path           text        PRIMARY KEY,
+    size           bigint      NOT NULL,
+    hash           CHAR(64)    NOT NULL,
+    byte_offset    bigint      NOT NULL default 0,
+    match_id       integer              DEFAULT NULL,
+    status         VARCHAR(16) NOT NULL,
+    parser_version integer     NOT NULL,
+    error          text                 DEFAULT NULL,
+    state          jsonb                DEFAULT NULL,
+    inserted_at    bigint      NOT NULL DEFAULT date_part('epoch'::text, now()),
+    updated_at     bigint      NOT NULL DEFAULT date_part('epoch'::text, now()),
+
+    FOREIGN KEY (match_id) REFERENCES matches (id) ON DELETE SET NULL
+);
+
+CREATE INDEX if not exists idx_ingested_files_hash
+    ON ingested_files (hash);
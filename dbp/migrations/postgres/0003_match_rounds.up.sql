@@ -0,0 +1,12 @@
+create table if not exists "match_rounds"
+(
+    match_id     integer     NOT NULL,
+    number       smallint    NOT NULL,
+    started_at   bigint      NOT NULL,
+    ended_at     bigint               DEFAULT NULL,
+    winner       VARCHAR(16)          DEFAULT NULL,
+    player_stats jsonb       NOT NULL default '{}'::jsonb,
+
+    FOREIGN KEY (match_id) REFERENCES matches (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    UNIQUE (match_id, number)
+);
@@ -0,0 +1,9 @@
+alter table "match_user_stats"
+    drop column suicides;
+alter table "match_user_stats"
+    drop column environment_deaths;
+
+alter table "users"
+    drop column suicides;
+alter table "users"
+    drop column environment_deaths;
@@ -0,0 +1,9 @@
+alter table "match_user_stats"
+    add column suicides integer NOT NULL default 0;
+alter table "match_user_stats"
+    add column environment_deaths integer NOT NULL default 0;
+
+alter table "users"
+    add column suicides integer NOT NULL default 0;
+alter table "users"
+    add column environment_deaths integer NOT NULL default 0;
@@ -0,0 +1,14 @@
+alter table "matches"
+    add column mode VARCHAR(32) NOT NULL default '';
+
+alter table "match_user_stats"
+    add column team VARCHAR(16) NOT NULL default '';
+alter table "match_user_stats"
+    add column pvp_kills integer NOT NULL default 0;
+alter table "match_user_stats"
+    add column pvp_deaths integer NOT NULL default 0;
+
+alter table "users"
+    add column pvp_kills integer NOT NULL default 0;
+alter table "users"
+    add column pvp_deaths integer NOT NULL default 0;
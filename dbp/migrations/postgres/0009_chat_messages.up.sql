@@ -0,0 +1,18 @@
+create table if not exists "chat_messages"
+(
+    match_id  integer     NOT NULL,
+    seq       integer     NOT NULL,
+    time      bigint      NOT NULL,
+    user_id   bigint               DEFAULT NULL,
+    steam_id  VARCHAR(32) NOT NULL,
+    name      VARCHAR(32) NOT NULL,
+    team      VARCHAR(16) NOT NULL,
+    team_only boolean     NOT NULL default false,
+    text      text        NOT NULL,
+
+    FOREIGN KEY (match_id) REFERENCES matches (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (match_id, seq)
+);
+
+create index if not exists idx_chat_messages_user on chat_messages (user_id);
+create index if not exists idx_chat_messages_time on chat_messages (time);
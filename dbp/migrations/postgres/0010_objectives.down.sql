@@ -0,0 +1,13 @@
+alter table "match_user_stats"
+    drop column captures;
+alter table "match_user_stats"
+    drop column caches_destroyed;
+alter table "match_user_stats"
+    drop column defends;
+
+alter table "users"
+    drop column captures;
+alter table "users"
+    drop column caches_destroyed;
+alter table "users"
+    drop column defends;
@@ -0,0 +1,22 @@
+update users
+set id = id - 76561197960265728
+where id >= 76561197960265728;
+
+update kill_events
+set attacker_id = attacker_id - 76561197960265728
+where attacker_id >= 76561197960265728;
+
+update kill_events
+set victim_id = victim_id - 76561197960265728
+where victim_id >= 76561197960265728;
+
+update chat_messages
+set user_id = user_id - 76561197960265728
+where user_id >= 76561197960265728;
+
+update match_rounds
+set player_stats = (SELECT COALESCE(jsonb_object_agg(CASE
+                                                         WHEN k::bigint >= 76561197960265728
+                                                             THEN (k::bigint - 76561197960265728)::text
+                                                         ELSE k END, v), '{}'::jsonb)
+                    FROM jsonb_each(player_stats) j(k, v));
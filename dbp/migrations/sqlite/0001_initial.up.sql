@@ -0,0 +1,53 @@
+create table if not exists "matches"
+(
+    id          integer PRIMARY KEY AUTOINCREMENT,
+    ip          VARCHAR(15) NOT NULL,
+    started_at  bigint      NOT NULL,
+    map         VARCHAR(50) NOT NULL,
+    rounds      smallint    NOT NULL,
+    duration    integer     NOT NULL,
+    won         bool        NOT NULL default false,
+    inserted_at bigint      NOT NULL DEFAULT (strftime('%s', 'now')),
+    UNIQUE (ip, started_at, map)
+);
+
+create table if not exists "users"
+(
+    id               bigint PRIMARY KEY,
+    name             VARCHAR(32) NOT NULL,
+    avatar_hash      CHAR(40)             DEFAULT NULL,
+    kills            integer     NOT NULL default 0,
+    deaths           integer     NOT NULL default 0,
+    fratricide       integer     NOT NULL default 0,
+    kd               numeric(10, 2)       DEFAULT NULL,
+    all_weapon_stats text        NOT NULL default '{}',
+    inserted_at      bigint      NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+CREATE INDEX if not exists idx_users_kills
+    ON users (kills);
+
+create table if not exists "match_user_stats"
+(
+    match_id     integer NOT NULL,
+    user_id      bigint  NOT NULL,
+    kills        integer NOT NULL default 0,
+    deaths       integer NOT NULL default 0,
+    fratricide   integer NOT NULL default 0,
+    weapon_stats text    NOT NULL default '{}',
+
+    FOREIGN KEY (match_id) REFERENCES matches (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    UNIQUE (match_id, user_id)
+);
+
+create table if not exists "user_medals"
+(
+    user_id  bigint  NOT NULL,
+    medal_id integer NOT NULL,
+    value    integer          default NULL,
+    current  bool    NOT NULL default false,
+
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    UNIQUE (user_id, medal_id)
+);
@@ -0,0 +1,21 @@
+create table if not exists "kill_events"
+(
+    match_id      integer     NOT NULL,
+    seq           integer     NOT NULL,
+    time          bigint      NOT NULL,
+    attacker_id   bigint               DEFAULT NULL,
+    attacker_name VARCHAR(64) NOT NULL,
+    attacker_team VARCHAR(16) NOT NULL,
+    attacker_bot  boolean     NOT NULL,
+    victim_id     bigint               DEFAULT NULL,
+    victim_name   VARCHAR(64) NOT NULL,
+    victim_team   VARCHAR(16) NOT NULL,
+    victim_bot    boolean     NOT NULL,
+    weapon        VARCHAR(64) NOT NULL,
+
+    FOREIGN KEY (match_id) REFERENCES matches (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (match_id, seq)
+);
+
+create index if not exists idx_kill_events_attacker on kill_events (attacker_id);
+create index if not exists idx_kill_events_victim on kill_events (victim_id);
@@ -0,0 +1,5 @@
+alter table "match_user_stats"
+    drop column death_weapon_stats;
+
+alter table "users"
+    drop column all_death_weapon_stats;
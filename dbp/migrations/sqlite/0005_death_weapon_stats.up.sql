@@ -0,0 +1,5 @@
+alter table "match_user_stats"
+    add column death_weapon_stats text NOT NULL default '{}';
+
+alter table "users"
+    add column all_death_weapon_stats text NOT NULL default '{}';
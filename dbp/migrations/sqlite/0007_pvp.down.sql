@@ -0,0 +1,14 @@
+alter table "matches"
+    drop column mode;
+
+alter table "match_user_stats"
+    drop column team;
+alter table "match_user_stats"
+    drop column pvp_kills;
+alter table "match_user_stats"
+    drop column pvp_deaths;
+
+alter table "users"
+    drop column pvp_kills;
+alter table "users"
+    drop column pvp_deaths;
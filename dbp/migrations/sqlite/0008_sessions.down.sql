@@ -0,0 +1,7 @@
+drop table if exists "match_sessions";
+
+alter table "match_user_stats"
+    drop column playtime;
+
+alter table "users"
+    drop column playtime;
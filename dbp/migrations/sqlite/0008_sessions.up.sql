@@ -0,0 +1,20 @@
+create table if not exists "match_sessions"
+(
+    match_id  integer NOT NULL,
+    user_id   bigint  NOT NULL,
+    joined_at bigint  NOT NULL,
+    left_at   bigint           DEFAULT NULL,
+    reason    text             DEFAULT NULL,
+
+    FOREIGN KEY (match_id) REFERENCES matches (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    UNIQUE (match_id, user_id, joined_at)
+);
+
+create index if not exists idx_match_sessions_user on match_sessions (user_id);
+
+alter table "match_user_stats"
+    add column playtime integer NOT NULL default 0;
+
+alter table "users"
+    add column playtime integer NOT NULL default 0;
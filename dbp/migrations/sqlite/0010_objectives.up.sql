@@ -0,0 +1,13 @@
+alter table "match_user_stats"
+    add column captures integer NOT NULL default 0;
+alter table "match_user_stats"
+    add column caches_destroyed integer NOT NULL default 0;
+alter table "match_user_stats"
+    add column defends integer NOT NULL default 0;
+
+alter table "users"
+    add column captures integer NOT NULL default 0;
+alter table "users"
+    add column caches_destroyed integer NOT NULL default 0;
+alter table "users"
+    add column defends integer NOT NULL default 0;
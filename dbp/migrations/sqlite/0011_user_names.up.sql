@@ -0,0 +1,15 @@
+create table if not exists "user_names"
+(
+    user_id    bigint      NOT NULL,
+    name       VARCHAR(32) NOT NULL,
+    first_seen bigint      NOT NULL default 0,
+    last_seen  bigint      NOT NULL default 0,
+
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    UNIQUE (user_id, name)
+);
+
+-- names of users created before the history was recorded, the time they were seen is unknown
+insert into user_names (user_id, name)
+select id, name
+from users;
@@ -0,0 +1,24 @@
+-- users were keyed by the account id of STEAM_X:Y:Z, their SteamID64 is the account id plus 76561197960265728.
+-- Tables with a foreign key to users are updated by ON UPDATE CASCADE.
+update users
+set id = id + 76561197960265728
+where id < 76561197960265728;
+
+update kill_events
+set attacker_id = attacker_id + 76561197960265728
+where attacker_id < 76561197960265728;
+
+update kill_events
+set victim_id = victim_id + 76561197960265728
+where victim_id < 76561197960265728;
+
+update chat_messages
+set user_id = user_id + 76561197960265728
+where user_id < 76561197960265728;
+
+update match_rounds
+set player_stats = (SELECT COALESCE(json_group_object(CASE
+                                                          WHEN CAST(key AS integer) < 76561197960265728
+                                                              THEN CAST(CAST(key AS integer) + 76561197960265728 AS text)
+                                                          ELSE key END, json(value)), '{}')
+                    FROM json_each(match_rounds.player_stats));
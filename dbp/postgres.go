@@ -0,0 +1,165 @@
+package dbp
+
+import (
+	"context"
+	"database/sql"
+	"github.com/j0y/insurgency-parser/parser"
+	"github.com/lib/pq"
+)
+
+// Postgres is the Store used with Supabase, the schema is created by migrate up, see migrations/postgres
+type Postgres struct {
+	sqlStore
+}
+
+func OpenPostgres(dataSourceName string) (*Postgres, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Postgres{newSQLStore(db)}, nil
+}
+
+func (p *Postgres) MigrateUp(ctx context.Context) ([]Migration, error) {
+	return p.migrateUp(ctx, "postgres")
+}
+
+func (p *Postgres) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	return p.migrateDown(ctx, "postgres", steps)
+}
+
+func (p *Postgres) Migrations(ctx context.Context) ([]Migration, error) {
+	return p.migrations(ctx, "postgres")
+}
+
+func (p *Postgres) InTx(ctx context.Context, fn func(tx Store) error) error {
+	return p.inTx(ctx, func(s sqlStore) Store { return &Postgres{s} }, fn)
+}
+
+// postgresAddUserStats adds the difference of match stats to the user totals, see insertUserStats
+const postgresAddUserStats = `UPDATE users
+SET kills            = kills + $2,
+    deaths           = deaths + $3,
+    fratricide       = fratricide + $4,
+    suicides         = suicides + $7,
+    environment_deaths = environment_deaths + $8,
+    pvp_kills        = pvp_kills + $9,
+    pvp_deaths       = pvp_deaths + $10,
+    playtime         = playtime + $11,
+    captures         = captures + $12,
+    caches_destroyed = caches_destroyed + $13,
+    defends          = defends + $14,
+    kd               = CASE
+                           WHEN kills + $2 <= 100 THEN kd
+                           WHEN deaths + $3 = 0 THEN 9999
+                           ELSE cast(kills + $2 as decimal) / (deaths + $3) END,
+    all_weapon_stats = (SELECT COALESCE(jsonb_object_agg(k, total), '{}'::jsonb)
+                        FROM (SELECT k, sum(v::numeric) AS total
+                              FROM (SELECT * FROM jsonb_each_text(all_weapon_stats)
+                                    UNION ALL
+                                    SELECT * FROM jsonb_each_text($5::jsonb)) w(k, v)
+                              GROUP BY k
+                              HAVING sum(v::numeric) != 0) t),
+    all_death_weapon_stats = (SELECT COALESCE(jsonb_object_agg(k, total), '{}'::jsonb)
+                              FROM (SELECT k, sum(v::numeric) AS total
+                                    FROM (SELECT * FROM jsonb_each_text(all_death_weapon_stats)
+                                          UNION ALL
+                                          SELECT * FROM jsonb_each_text($6::jsonb)) w(k, v)
+                                    GROUP BY k
+                                    HAVING sum(v::numeric) != 0) t)
+WHERE id = $1`
+
+func (p *Postgres) InsertUserStats(ctx context.Context, matchID uint32, userID int64, stats parser.PlayerStats) error {
+	return p.insertUserStats(ctx, postgresAddUserStats, matchID, userID, stats)
+}
+
+func (p *Postgres) RebuildUserAggregates(ctx context.Context) error {
+	kills := `update users
+set kills = a.total
+    from (select user_id, sum(kills) as total from match_user_stats group by user_id) a
+WHERE users.id = a.user_id;`
+
+	deaths := `update users
+set deaths = a.total
+    from (select user_id, sum(deaths) as total from match_user_stats group by user_id) a
+WHERE users.id = a.user_id;`
+
+	frats := `update users
+set fratricide = a.total
+    from (select user_id, sum(fratricide) as total from match_user_stats group by user_id) a
+WHERE users.id = a.user_id;`
+
+	suicides := `update users
+set suicides = a.suicides, environment_deaths = a.environment_deaths
+    from (select user_id, sum(suicides) as suicides, sum(environment_deaths) as environment_deaths
+          from match_user_stats group by user_id) a
+WHERE users.id = a.user_id;`
+
+	pvp := `update users
+set pvp_kills = a.pvp_kills, pvp_deaths = a.pvp_deaths, playtime = a.playtime
+    from (select user_id, sum(pvp_kills) as pvp_kills, sum(pvp_deaths) as pvp_deaths, sum(playtime) as playtime
+          from match_user_stats group by user_id) a
+WHERE users.id = a.user_id;`
+
+	objectives := `update users
+set captures = a.captures, caches_destroyed = a.caches_destroyed, defends = a.defends
+    from (select user_id, sum(captures) as captures, sum(caches_destroyed) as caches_destroyed, sum(defends) as defends
+          from match_user_stats group by user_id) a
+WHERE users.id = a.user_id;`
+
+	kd := `update users
+set kd = cast(kills as decimal)/deaths
+where kills > 100 and deaths != 0;`
+
+	kdmax := `update users
+set kd = 9999
+where kills > 100 and deaths = 0`
+
+	allWeaponStats := `update users set all_weapon_stats = stats.agg from (
+select user_id, jsonb_object_agg(k, val) as agg
+from (
+         select user_id, k, sum(v::numeric) as val
+         from match_user_stats
+                  join lateral jsonb_each_text(weapon_stats) j(k, v) on true
+         group by user_id, k
+     ) tt
+group by user_id) stats
+where user_id = id`
+
+	allDeathWeaponStats := `update users set all_death_weapon_stats = stats.agg from (
+select user_id, jsonb_object_agg(k, val) as agg
+from (
+         select user_id, k, sum(v::numeric) as val
+         from match_user_stats
+                  join lateral jsonb_each_text(death_weapon_stats) j(k, v) on true
+         group by user_id, k
+     ) tt
+group by user_id) stats
+where user_id = id`
+
+	for _, query := range []string{kills, deaths, frats, suicides, pvp, objectives, kd, kdmax, allWeaponStats, allDeathWeaponStats} {
+		_, err := p.db.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Postgres) SearchChat(ctx context.Context, filter ChatFilter) ([]ChatMessage, error) {
+	return p.searchChat(ctx, "ILIKE", filter)
+}
+
+func (p *Postgres) UsersByWeaponKills(ctx context.Context, medal int, weapons []string, min uint32) ([]int64, error) {
+	query := `
+SELECT users.id
+from users
+         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
+WHERE um.user_id IS NULL
+  AND (SELECT COALESCE(SUM((all_weapon_stats ->> w)::int), 0) FROM unnest($2::text[]) w) >= $3
+`
+
+	return p.queryIDs(ctx, query, medal, pq.Array(weapons), min)
+}
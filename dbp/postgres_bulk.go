@@ -0,0 +1,471 @@
+package dbp
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/lib/pq"
+	"time"
+)
+
+// BulkLoad copies the files into temporary staging tables and merges them with a few set based queries,
+// which is much faster than row by row upserts when backfilling archives
+func (p *Postgres) BulkLoad(ctx context.Context, files []BulkFile) error {
+	return p.InTx(ctx, func(tx Store) error {
+		db := tx.(*Postgres).db
+
+		staging := []string{
+			`CREATE TEMP TABLE staging_matches
+(
+    ip         VARCHAR(15),
+    started_at bigint,
+    map        VARCHAR(50),
+    rounds     smallint,
+    duration   integer,
+    won        bool,
+    mode       VARCHAR(32)
+) ON COMMIT DROP`,
+			`CREATE TEMP TABLE staging_stats
+(
+    ip                 VARCHAR(15),
+    started_at         bigint,
+    map                VARCHAR(50),
+    user_id            bigint,
+    name               VARCHAR(32),
+    team               VARCHAR(16),
+    kills              integer,
+    pvp_kills          integer,
+    pvp_deaths         integer,
+    playtime           integer,
+    captures           integer,
+    caches_destroyed   integer,
+    defends            integer,
+    deaths             integer,
+    fratricide         integer,
+    suicides           integer,
+    environment_deaths integer,
+    weapon_stats       jsonb,
+    death_weapon_stats jsonb
+) ON COMMIT DROP`,
+			`CREATE TEMP TABLE staging_rounds
+(
+    ip               VARCHAR(15),
+    started_at       bigint,
+    map              VARCHAR(50),
+    number           smallint,
+    round_started_at bigint,
+    ended_at         bigint,
+    winner           VARCHAR(16),
+    player_stats     jsonb
+) ON COMMIT DROP`,
+			`CREATE TEMP TABLE staging_kills
+(
+    ip            VARCHAR(15),
+    started_at    bigint,
+    map           VARCHAR(50),
+    seq           integer,
+    time          bigint,
+    attacker_id   bigint,
+    attacker_name VARCHAR(64),
+    attacker_team VARCHAR(16),
+    attacker_bot  boolean,
+    victim_id     bigint,
+    victim_name   VARCHAR(64),
+    victim_team   VARCHAR(16),
+    victim_bot    boolean,
+    weapon        VARCHAR(64)
+) ON COMMIT DROP`,
+			`CREATE TEMP TABLE staging_sessions
+(
+    ip         VARCHAR(15),
+    started_at bigint,
+    map        VARCHAR(50),
+    user_id    bigint,
+    joined_at  bigint,
+    left_at    bigint,
+    reason     text
+) ON COMMIT DROP`,
+			`CREATE TEMP TABLE staging_chat
+(
+    ip         VARCHAR(15),
+    started_at bigint,
+    map        VARCHAR(50),
+    seq        integer,
+    time       bigint,
+    user_id    bigint,
+    steam_id   VARCHAR(32),
+    name       VARCHAR(32),
+    team       VARCHAR(16),
+    team_only  boolean,
+    text       text
+) ON COMMIT DROP`,
+			`CREATE TEMP TABLE staging_names
+(
+    user_id    bigint,
+    name       VARCHAR(32),
+    first_seen bigint,
+    last_seen  bigint
+) ON COMMIT DROP`,
+			`CREATE TEMP TABLE staging_files
+(
+    path           text,
+    size           bigint,
+    hash           CHAR(64),
+    byte_offset    bigint,
+    status         VARCHAR(16),
+    parser_version integer,
+    state          jsonb,
+    ip             VARCHAR(15),
+    started_at     bigint,
+    map            VARCHAR(50)
+) ON COMMIT DROP`,
+		}
+		for _, query := range staging {
+			_, err := db.ExecContext(ctx, query)
+			if err != nil {
+				return err
+			}
+		}
+
+		matches := make([][]interface{}, 0)
+		stats := make([][]interface{}, 0)
+		rounds := make([][]interface{}, 0)
+		kills := make([][]interface{}, 0)
+		sessions := make([][]interface{}, 0)
+		chat := make([][]interface{}, 0)
+		names := make([][]interface{}, 0)
+		ledger := make([][]interface{}, 0, len(files))
+		for _, file := range files {
+			for _, match := range file.Matches {
+				m := match.Match
+				matches = append(matches, []interface{}{m.Ip, m.StartedAt, m.Map, m.Rounds, m.Duration, m.Won, m.Mode})
+
+				for userID, s := range match.Players {
+					stats = append(stats, []interface{}{m.Ip, m.StartedAt, m.Map, userID, s.Name, s.Team, s.Kills, s.Deaths,
+						s.PvPKills, s.PvPDeaths, s.Playtime, s.Captures, s.CachesDestroyed, s.Defends, s.Fratricide, s.Suicides, s.EnvironmentDeaths, s.WeaponStats, s.DeathWeaponStats})
+				}
+
+				for _, round := range match.Rounds {
+					playerStats, err := json.Marshal(round.Players)
+					if err != nil {
+						return err
+					}
+					r := round.Round
+					var endedAt, winner interface{}
+					if r.EndedAt != 0 {
+						endedAt = r.EndedAt
+					}
+					if len(r.Winner) > 0 {
+						winner = r.Winner
+					}
+					rounds = append(rounds, []interface{}{m.Ip, m.StartedAt, m.Map, r.Number, r.StartedAt, endedAt,
+						winner, string(playerStats)})
+				}
+
+				for _, kill := range match.Kills {
+					k := kill.Kill
+					var attackerID, victimID interface{}
+					if kill.AttackerID != 0 {
+						attackerID = kill.AttackerID
+					}
+					if kill.VictimID != 0 {
+						victimID = kill.VictimID
+					}
+					kills = append(kills, []interface{}{m.Ip, m.StartedAt, m.Map, k.Seq, k.Time,
+						attackerID, k.Attacker.Name, k.Attacker.Team, k.Attacker.IsBot(),
+						victimID, k.Victim.Name, k.Victim.Team, k.Victim.IsBot(), k.Weapon})
+				}
+
+				for _, session := range match.Sessions {
+					s := session.Session
+					var leftAt, reason interface{}
+					if s.LeftAt != 0 {
+						leftAt = s.LeftAt
+					}
+					if len(s.Reason) > 0 {
+						reason = s.Reason
+					}
+					sessions = append(sessions, []interface{}{m.Ip, m.StartedAt, m.Map, session.UserID, s.JoinedAt, leftAt,
+						reason})
+				}
+
+				for _, message := range match.Chat {
+					c := message.Message
+					var userID interface{}
+					if message.UserID != 0 {
+						userID = message.UserID
+					}
+					chat = append(chat, []interface{}{m.Ip, m.StartedAt, m.Map, c.Seq, c.Time, userID, c.SteamID, c.Name,
+						c.Team, c.TeamOnly, c.Text})
+				}
+
+				for _, name := range match.Names {
+					names = append(names, []interface{}{name.UserID, name.Name, name.FirstSeen, name.LastSeen})
+				}
+			}
+
+			f := file.Ingested
+			var state interface{}
+			if len(f.State) > 0 {
+				state = string(f.State)
+			}
+			var ip, startedAt, mapName interface{}
+			if len(file.LastMatch.Map) > 0 {
+				ip, startedAt, mapName = file.LastMatch.Ip, file.LastMatch.StartedAt, file.LastMatch.Map
+			}
+			ledger = append(ledger, []interface{}{f.Path, f.Size, f.Hash, f.Offset, f.Status, f.ParserVersion, state,
+				ip, startedAt, mapName})
+		}
+
+		err := copyRows(ctx, db, "staging_matches", []string{"ip", "started_at", "map", "rounds", "duration", "won", "mode"}, matches)
+		if err != nil {
+			return err
+		}
+		err = copyRows(ctx, db, "staging_stats", []string{"ip", "started_at", "map", "user_id", "name", "team", "kills", "deaths",
+			"pvp_kills", "pvp_deaths", "playtime", "captures", "caches_destroyed", "defends", "fratricide", "suicides", "environment_deaths", "weapon_stats", "death_weapon_stats"}, stats)
+		if err != nil {
+			return err
+		}
+		err = copyRows(ctx, db, "staging_rounds", []string{"ip", "started_at", "map", "number", "round_started_at",
+			"ended_at", "winner", "player_stats"}, rounds)
+		if err != nil {
+			return err
+		}
+		err = copyRows(ctx, db, "staging_kills", []string{"ip", "started_at", "map", "seq", "time", "attacker_id",
+			"attacker_name", "attacker_team", "attacker_bot", "victim_id", "victim_name", "victim_team", "victim_bot",
+			"weapon"}, kills)
+		if err != nil {
+			return err
+		}
+		err = copyRows(ctx, db, "staging_sessions", []string{"ip", "started_at", "map", "user_id", "joined_at", "left_at",
+			"reason"}, sessions)
+		if err != nil {
+			return err
+		}
+		err = copyRows(ctx, db, "staging_chat", []string{"ip", "started_at", "map", "seq", "time", "user_id", "steam_id",
+			"name", "team", "team_only", "text"}, chat)
+		if err != nil {
+			return err
+		}
+		err = copyRows(ctx, db, "staging_names", []string{"user_id", "name", "first_seen", "last_seen"}, names)
+		if err != nil {
+			return err
+		}
+		err = copyRows(ctx, db, "staging_files", []string{"path", "size", "hash", "byte_offset", "status", "parser_version",
+			"state", "ip", "started_at", "map"}, ledger)
+		if err != nil {
+			return err
+		}
+
+		// a match can be in several files, the longest version wins
+		mergeMatches := `INSERT INTO matches (ip, started_at, map, rounds, duration, won, mode)
+SELECT DISTINCT ON (ip, started_at, map) ip, started_at, map, rounds, duration, won, mode
+FROM staging_matches
+ORDER BY ip, started_at, map, duration DESC, rounds DESC
+ON CONFLICT(ip, started_at, map) DO UPDATE SET rounds = excluded.rounds, duration = excluded.duration, won = excluded.won,
+                                               mode = excluded.mode`
+
+		mergeUsers := `INSERT INTO users (id, name)
+SELECT DISTINCT ON (user_id) user_id, name
+FROM staging_stats
+ORDER BY user_id, started_at
+ON CONFLICT(id) DO NOTHING`
+
+		// players who only chatted have a name but no stats
+		mergeNameUsers := `INSERT INTO users (id, name)
+SELECT DISTINCT ON (user_id) user_id, name
+FROM staging_names
+ORDER BY user_id, first_seen
+ON CONFLICT(id) DO NOTHING`
+
+		// the difference to stats already stored is added to the users totals after the merge
+		deltas := `CREATE TEMP TABLE staging_deltas ON COMMIT DROP AS
+SELECT s.user_id,
+       s.kills - COALESCE(o.kills, 0)                           AS kills,
+       s.deaths - COALESCE(o.deaths, 0)                         AS deaths,
+       s.fratricide - COALESCE(o.fratricide, 0)                 AS fratricide,
+       s.suicides - COALESCE(o.suicides, 0)                     AS suicides,
+       s.environment_deaths - COALESCE(o.environment_deaths, 0) AS environment_deaths,
+       s.pvp_kills - COALESCE(o.pvp_kills, 0)                   AS pvp_kills,
+       s.pvp_deaths - COALESCE(o.pvp_deaths, 0)                 AS pvp_deaths,
+       s.playtime - COALESCE(o.playtime, 0)                     AS playtime,
+       s.captures - COALESCE(o.captures, 0)                     AS captures,
+       s.caches_destroyed - COALESCE(o.caches_destroyed, 0)     AS caches_destroyed,
+       s.defends - COALESCE(o.defends, 0)                       AS defends,
+       s.weapon_stats                                           AS weapon_stats,
+       COALESCE(o.weapon_stats, '{}'::jsonb)                    AS old_weapon_stats,
+       s.death_weapon_stats                                     AS death_weapon_stats,
+       COALESCE(o.death_weapon_stats, '{}'::jsonb)              AS old_death_weapon_stats
+FROM (SELECT DISTINCT ON (m.id, s.user_id) m.id AS match_id, s.user_id, s.kills, s.deaths, s.fratricide, s.suicides,
+                                           s.environment_deaths, s.pvp_kills, s.pvp_deaths, s.playtime, s.captures,
+                                           s.caches_destroyed, s.defends, s.weapon_stats, s.death_weapon_stats
+      FROM staging_stats s
+               JOIN matches m on m.ip = s.ip AND m.started_at = s.started_at AND m.map = s.map
+      ORDER BY m.id, s.user_id, s.playtime DESC,
+               s.kills + s.deaths + s.pvp_kills + s.pvp_deaths + s.fratricide + s.suicides + s.environment_deaths +
+               s.captures + s.caches_destroyed + s.defends DESC) s
+         LEFT JOIN match_user_stats o on o.match_id = s.match_id AND o.user_id = s.user_id`
+
+		mergeStats := `INSERT INTO match_user_stats (match_id, user_id, team, kills, deaths, pvp_kills, pvp_deaths, playtime,
+                              captures, caches_destroyed, defends, fratricide, suicides, environment_deaths,
+                              weapon_stats, death_weapon_stats)
+SELECT DISTINCT ON (m.id, s.user_id) m.id, s.user_id, s.team, s.kills, s.deaths, s.pvp_kills, s.pvp_deaths, s.playtime,
+                                     s.captures, s.caches_destroyed, s.defends, s.fratricide, s.suicides,
+                                     s.environment_deaths, s.weapon_stats, s.death_weapon_stats
+FROM staging_stats s
+         JOIN matches m on m.ip = s.ip AND m.started_at = s.started_at AND m.map = s.map
+ORDER BY m.id, s.user_id, s.playtime DESC,
+         s.kills + s.deaths + s.pvp_kills + s.pvp_deaths + s.fratricide + s.suicides + s.environment_deaths +
+         s.captures + s.caches_destroyed + s.defends DESC
+ON CONFLICT(match_id, user_id) DO UPDATE SET team = excluded.team, kills = excluded.kills, deaths = excluded.deaths,
+                                             pvp_kills = excluded.pvp_kills, pvp_deaths = excluded.pvp_deaths,
+                                             playtime = excluded.playtime, captures = excluded.captures,
+                                             caches_destroyed = excluded.caches_destroyed, defends = excluded.defends,
+                                             fratricide = excluded.fratricide, suicides = excluded.suicides,
+                                             environment_deaths = excluded.environment_deaths,
+                                             weapon_stats = excluded.weapon_stats,
+                                             death_weapon_stats = excluded.death_weapon_stats`
+
+		addTotals := `UPDATE users
+SET kills            = users.kills + d.kills,
+    deaths           = users.deaths + d.deaths,
+    fratricide       = users.fratricide + d.fratricide,
+    suicides         = users.suicides + d.suicides,
+    environment_deaths = users.environment_deaths + d.environment_deaths,
+    pvp_kills        = users.pvp_kills + d.pvp_kills,
+    pvp_deaths       = users.pvp_deaths + d.pvp_deaths,
+    playtime         = users.playtime + d.playtime,
+    captures         = users.captures + d.captures,
+    caches_destroyed = users.caches_destroyed + d.caches_destroyed,
+    defends          = users.defends + d.defends,
+    all_weapon_stats = (SELECT COALESCE(jsonb_object_agg(k, total), '{}'::jsonb)
+                        FROM (SELECT k, sum(v) AS total
+                              FROM (SELECT k, v::numeric AS v FROM jsonb_each_text(users.all_weapon_stats) j(k, v)
+                                    UNION ALL
+                                    SELECT k, v::numeric FROM staging_deltas sd, jsonb_each_text(sd.weapon_stats) j(k, v)
+                                    WHERE sd.user_id = users.id
+                                    UNION ALL
+                                    SELECT k, -v::numeric FROM staging_deltas sd, jsonb_each_text(sd.old_weapon_stats) j(k, v)
+                                    WHERE sd.user_id = users.id) w
+                              GROUP BY k
+                              HAVING sum(v) != 0) t),
+    all_death_weapon_stats = (SELECT COALESCE(jsonb_object_agg(k, total), '{}'::jsonb)
+                              FROM (SELECT k, sum(v) AS total
+                                    FROM (SELECT k, v::numeric AS v FROM jsonb_each_text(users.all_death_weapon_stats) j(k, v)
+                                          UNION ALL
+                                          SELECT k, v::numeric FROM staging_deltas sd, jsonb_each_text(sd.death_weapon_stats) j(k, v)
+                                          WHERE sd.user_id = users.id
+                                          UNION ALL
+                                          SELECT k, -v::numeric FROM staging_deltas sd, jsonb_each_text(sd.old_death_weapon_stats) j(k, v)
+                                          WHERE sd.user_id = users.id) w
+                                    GROUP BY k
+                                    HAVING sum(v) != 0) t)
+FROM (SELECT user_id, sum(kills) AS kills, sum(deaths) AS deaths, sum(fratricide) AS fratricide,
+             sum(suicides) AS suicides, sum(environment_deaths) AS environment_deaths,
+             sum(pvp_kills) AS pvp_kills, sum(pvp_deaths) AS pvp_deaths, sum(playtime) AS playtime,
+             sum(captures) AS captures, sum(caches_destroyed) AS caches_destroyed, sum(defends) AS defends
+      FROM staging_deltas
+      GROUP BY user_id) d
+WHERE users.id = d.user_id`
+
+		kd := `UPDATE users
+SET kd = CASE WHEN deaths = 0 THEN 9999 ELSE cast(kills as decimal) / deaths END
+WHERE kills > 100
+  AND id IN (SELECT user_id FROM staging_deltas)`
+
+		mergeRounds := `INSERT INTO match_rounds (match_id, number, started_at, ended_at, winner, player_stats)
+SELECT DISTINCT ON (m.id, r.number) m.id, r.number, r.round_started_at, r.ended_at, r.winner, r.player_stats
+FROM staging_rounds r
+         JOIN matches m on m.ip = r.ip AND m.started_at = r.started_at AND m.map = r.map
+ORDER BY m.id, r.number, r.ended_at DESC NULLS LAST
+ON CONFLICT(match_id, number) DO UPDATE SET started_at = excluded.started_at, ended_at = excluded.ended_at,
+                                            winner = excluded.winner, player_stats = excluded.player_stats`
+
+		mergeKills := `INSERT INTO kill_events (match_id, seq, time, attacker_id, attacker_name, attacker_team, attacker_bot,
+                         victim_id, victim_name, victim_team, victim_bot, weapon)
+SELECT DISTINCT ON (m.id, k.seq) m.id, k.seq, k.time, k.attacker_id, k.attacker_name, k.attacker_team, k.attacker_bot,
+                                 k.victim_id, k.victim_name, k.victim_team, k.victim_bot, k.weapon
+FROM staging_kills k
+         JOIN matches m on m.ip = k.ip AND m.started_at = k.started_at AND m.map = k.map
+ORDER BY m.id, k.seq
+ON CONFLICT(match_id, seq) DO NOTHING`
+
+		mergeSessions := `INSERT INTO match_sessions (match_id, user_id, joined_at, left_at, reason)
+SELECT DISTINCT ON (m.id, s.user_id, s.joined_at) m.id, s.user_id, s.joined_at, s.left_at, s.reason
+FROM staging_sessions s
+         JOIN matches m on m.ip = s.ip AND m.started_at = s.started_at AND m.map = s.map
+ORDER BY m.id, s.user_id, s.joined_at, s.left_at DESC NULLS LAST
+ON CONFLICT(match_id, user_id, joined_at) DO UPDATE SET left_at = excluded.left_at, reason = excluded.reason`
+
+		mergeChat := `INSERT INTO chat_messages (match_id, seq, time, user_id, steam_id, name, team, team_only, text)
+SELECT DISTINCT ON (m.id, c.seq) m.id, c.seq, c.time, c.user_id, c.steam_id, c.name, c.team, c.team_only, c.text
+FROM staging_chat c
+         JOIN matches m on m.ip = c.ip AND m.started_at = c.started_at AND m.map = c.map
+ORDER BY m.id, c.seq
+ON CONFLICT(match_id, seq) DO NOTHING`
+
+		mergeNames := `INSERT INTO user_names (user_id, name, first_seen, last_seen)
+SELECT user_id, name, min(first_seen), max(last_seen)
+FROM staging_names
+GROUP BY user_id, name
+ON CONFLICT(user_id, name) DO UPDATE
+    SET first_seen = CASE
+                         WHEN user_names.first_seen = 0 THEN excluded.first_seen
+                         ELSE LEAST(user_names.first_seen, excluded.first_seen) END,
+        last_seen  = GREATEST(user_names.last_seen, excluded.last_seen)`
+
+		// users are named by the name they were seen with last
+		currentNames := `UPDATE users
+SET name = n.name
+FROM (SELECT DISTINCT ON (user_id) user_id, name
+      FROM user_names
+      WHERE user_id IN (SELECT user_id FROM staging_names)
+      ORDER BY user_id, last_seen DESC, first_seen DESC) n
+WHERE users.id = n.user_id
+  AND users.name != n.name`
+
+		mergeFiles := `INSERT INTO ingested_files (path, size, hash, byte_offset, match_id, status, parser_version, error, state, inserted_at, updated_at)
+SELECT f.path, f.size, f.hash, f.byte_offset, m.id, f.status, f.parser_version, NULL, f.state, $1, $1
+FROM staging_files f
+         LEFT JOIN matches m on m.ip = f.ip AND m.started_at = f.started_at AND m.map = f.map
+ON CONFLICT(path) DO UPDATE SET size = excluded.size, hash = excluded.hash, byte_offset = excluded.byte_offset,
+                                match_id = excluded.match_id, status = excluded.status,
+                                parser_version = excluded.parser_version, error = NULL, state = excluded.state,
+                                updated_at = excluded.updated_at`
+
+		for _, query := range []string{mergeMatches, mergeUsers, mergeNameUsers, deltas, mergeStats, addTotals, kd,
+			mergeRounds, mergeKills, mergeSessions, mergeChat, mergeNames, currentNames} {
+			_, err = db.ExecContext(ctx, query)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = db.ExecContext(ctx, mergeFiles, time.Now().Unix())
+
+		return err
+	})
+}
+
+// copyRows loads rows into the table with COPY
+func copyRows(ctx context.Context, db querier, table string, columns []string, rows [][]interface{}) error {
+	stmt, err := db.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		_, err = stmt.ExecContext(ctx, row...)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	// flushes the buffered rows
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		stmt.Close()
+		return err
+	}
+
+	return stmt.Close()
+}
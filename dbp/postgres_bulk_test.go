@@ -0,0 +1,172 @@
+package dbp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/j0y/insurgency-parser/parser"
+	"github.com/lib/pq"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// errRollback undoes the writes of a test which runs against a real database
+var errRollback = errors.New("rollback")
+
+// testPostgres opens the database in DATABASE_URL which has to be migrated up,
+// tests using it are skipped when it's not set and must not commit anything
+func testPostgres(t *testing.T) *Postgres {
+	t.Helper()
+	dataSourceName := os.Getenv("DATABASE_URL")
+	if len(dataSourceName) == 0 {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	store, err := OpenPostgres(dataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+// queryRows returns the rows printed as strings
+func queryRows(t *testing.T, ctx context.Context, db querier, query string, args ...interface{}) []string {
+	t.Helper()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]string, 0)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, value := range values {
+			if b, ok := value.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result = append(result, strings.TrimSuffix(fmt.Sprintln(values...), "\n"))
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestBulkLoadLikeMatchByMatch(t *testing.T) {
+	ctx := context.Background()
+	store := testPostgres(t)
+
+	// a TEST-NET address no server has
+	market := parser.MatchInfo{Map: "market", StartedAt: 1, Rounds: 1, Duration: 300, Ip: "192.0.2.1"}
+	marketOver := parser.MatchInfo{Map: "market", Mode: "push", StartedAt: 1, Rounds: 2, Duration: 600, Won: true,
+		Ip: "192.0.2.1"}
+	sinjar := parser.MatchInfo{Map: "sinjar", StartedAt: 2, Duration: 600, Ip: "192.0.2.1"}
+	userIDs := []int64{1, 2}
+	alice := parser.PlayerStats{Name: "Alice", Kills: 60, Deaths: 2, Playtime: 290, Captures: 2, Defends: 1,
+		WeaponStats: parser.WeaponStats{"akm": 60}, DeathWeaponStats: parser.WeaponStats{"rpk": 2}}
+	bob := parser.PlayerStats{Name: "Bob", Team: "Insurgent", Kills: 110, PvPKills: 1, Fratricide: 1,
+		Suicides: 2, EnvironmentDeaths: 1, WeaponStats: parser.WeaponStats{"akm": 100, "m67": 10}}
+
+	files := []BulkFile{
+		{
+			Ingested: IngestedFile{Path: "test/192.0.2.1_27015_1.log", Size: 10, Hash: "a", Offset: 10,
+				Status: FileStatusParsing, ParserVersion: 1, State: []byte(`{}`)},
+			Matches: []MatchStats{{Match: market, Players: map[int64]parser.PlayerStats{
+				1: {Name: "Alice", Kills: 30, Deaths: 1, WeaponStats: parser.WeaponStats{"akm": 30}},
+			}, Sessions: []Session{{Session: parser.Session{JoinedAt: 10}, UserID: 1}}}},
+			LastMatch: market,
+		},
+		// the same match parsed further in a copy of the log, and the next one
+		{
+			Ingested: IngestedFile{Path: "test/192.0.2.1_27015_2.log", Size: 20, Hash: "b", Offset: 20,
+				Status: FileStatusParsed, ParserVersion: 1},
+			Matches: []MatchStats{
+				{Match: marketOver, Players: map[int64]parser.PlayerStats{1: alice, 2: bob},
+					Sessions: []Session{{Session: parser.Session{JoinedAt: 10, LeftAt: 300, Reason: "Disconnect"}, UserID: 1}},
+					Names: []UserName{{UserID: 1, Name: "Alice", FirstSeen: 10, LastSeen: 200},
+						{UserID: 1, Name: "Alicia", FirstSeen: 200, LastSeen: 300}}},
+				{Match: sinjar, Players: map[int64]parser.PlayerStats{1: alice}},
+			},
+			LastMatch: sinjar,
+		},
+	}
+
+	loads := map[string]func(tx Store) error{
+		"bulk": func(tx Store) error {
+			return tx.(BulkLoader).BulkLoad(ctx, files)
+		},
+		"match by match": func(tx Store) error {
+			for _, file := range files {
+				for _, match := range file.Matches {
+					matchIDs := writeMatches(t, ctx, tx, testMatch{info: match.Match, players: match.Players,
+						sessions: match.Sessions, names: match.Names})
+					file.Ingested.MatchID = matchIDs[0]
+				}
+				err := tx.SaveIngestedFile(ctx, file.Ingested)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+
+	results := make(map[string][]string)
+	for name, load := range loads {
+		err := store.InTx(ctx, func(tx Store) error {
+			err := load(tx)
+			if err != nil {
+				return err
+			}
+
+			db := tx.(*Postgres).db
+			results[name] = append(queryRows(t, ctx, db, `SELECT id, name, kills, deaths, pvp_kills, pvp_deaths, playtime, captures, caches_destroyed,
+       defends, fratricide, suicides, environment_deaths, kd, all_weapon_stats, all_death_weapon_stats
+FROM users WHERE id = ANY($1) ORDER BY id`, pq.Array(userIDs)),
+				queryRows(t, ctx, db, `SELECT m.map, m.mode, m.rounds, m.duration, m.won, s.user_id, s.team, s.kills, s.deaths,
+       s.pvp_kills, s.pvp_deaths, s.playtime, s.captures, s.caches_destroyed, s.defends, s.fratricide, s.suicides,
+       s.environment_deaths, s.weapon_stats, s.death_weapon_stats
+FROM match_user_stats s JOIN matches m ON m.id = s.match_id
+WHERE m.ip = $1 ORDER BY m.started_at, s.user_id`, "192.0.2.1")...)
+			results[name] = append(results[name], queryRows(t, ctx, db, `SELECT m.map, s.user_id, s.joined_at, s.left_at, s.reason
+FROM match_sessions s JOIN matches m ON m.id = s.match_id
+WHERE m.ip = $1 ORDER BY m.started_at, s.user_id, s.joined_at`, "192.0.2.1")...)
+			results[name] = append(results[name], queryRows(t, ctx, db, `SELECT user_id, name, first_seen, last_seen
+FROM user_names WHERE user_id = ANY($1) ORDER BY user_id, name`, pq.Array(userIDs))...)
+			results[name] = append(results[name], queryRows(t, ctx, db, `SELECT f.path, f.status, f.byte_offset, m.map
+FROM ingested_files f LEFT JOIN matches m ON m.id = f.match_id
+WHERE f.path LIKE 'test/%' ORDER BY f.path`)...)
+
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(results["bulk"], results["match by match"]) {
+		t.Errorf("bulk load wrote %q, match by match %q", results["bulk"], results["match by match"])
+	}
+	if len(results["bulk"]) != 2+3+1+2+2 {
+		t.Errorf("got %d rows, want 2 users, 3 stats, 1 session, 2 names and 2 files", len(results["bulk"]))
+	}
+}
@@ -0,0 +1,537 @@
+package dbp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/j0y/insurgency-parser/parser"
+	"math"
+	"strings"
+	"time"
+)
+
+// sqlStore holds the queries which are the same for every SQL database,
+// dialect specific ones are implemented by Postgres and SQLite
+type sqlStore struct {
+	// db is conn or the transaction the store was created for
+	db   querier
+	conn *sql.DB
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+func newSQLStore(conn *sql.DB) sqlStore {
+	return sqlStore{db: conn, conn: conn}
+}
+
+func (s *sqlStore) Close() error {
+	if s.conn == nil {
+		// stores of transactions are closed by committing
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// inTx runs fn with a store created by wrap for a new transaction,
+// the transaction of a store which is already in one is reused
+func (s *sqlStore) inTx(ctx context.Context, wrap func(sqlStore) Store, fn func(tx Store) error) error {
+	if s.conn == nil {
+		return fn(wrap(*s))
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(wrap(sqlStore{db: tx}))
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			return fmt.Errorf("%w, rollback failed: %v", err, rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) GetOrCreateMatchID(ctx context.Context, matchInfo parser.MatchInfo) (uint32, error) {
+	upsertQuery := `INSERT INTO matches (ip, started_at, map, rounds, duration, won, mode) VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT(ip, started_at, map) DO UPDATE SET rounds = $4, duration = $5, won = $6, mode = $7
+RETURNING id`
+
+	var matchID uint32
+	err := s.db.QueryRowContext(ctx, upsertQuery, matchInfo.Ip, matchInfo.StartedAt, matchInfo.Map, matchInfo.Rounds, matchInfo.Duration, matchInfo.Won, matchInfo.Mode).Scan(&matchID)
+	if err != nil {
+		return 0, err
+	}
+
+	return matchID, nil
+}
+
+func (s *sqlStore) CheckOrCreateUser(ctx context.Context, userID int64, name string) error {
+	// a single statement, so parallel transactions creating the same user wait for each other instead of failing
+	insertQuery := `INSERT INTO users (id, name) VALUES ($1, $2) ON CONFLICT(id) DO NOTHING`
+
+	_, err := s.db.ExecContext(ctx, insertQuery, userID, name)
+	return err
+}
+
+func (s *sqlStore) SaveUserName(ctx context.Context, name UserName) error {
+	// times of names from before the history was recorded are replaced by the first real ones
+	upsertQuery := `INSERT INTO user_names (user_id, name, first_seen, last_seen) VALUES ($1, $2, $3, $4)
+ON CONFLICT(user_id, name) DO UPDATE
+    SET first_seen = CASE
+                         WHEN user_names.first_seen = 0 OR excluded.first_seen < user_names.first_seen
+                             THEN excluded.first_seen
+                         ELSE user_names.first_seen END,
+        last_seen  = CASE
+                         WHEN excluded.last_seen > user_names.last_seen THEN excluded.last_seen
+                         ELSE user_names.last_seen END`
+
+	_, err := s.db.ExecContext(ctx, upsertQuery, name.UserID, name.Name, name.FirstSeen, name.LastSeen)
+	if err != nil {
+		return err
+	}
+
+	updateQuery := `UPDATE users
+SET name = $2
+WHERE id = $1
+  AND NOT EXISTS(SELECT 1
+                 FROM user_names newer
+                          JOIN user_names saved ON saved.user_id = newer.user_id AND saved.name = $2
+                 WHERE newer.user_id = $1
+                   AND newer.last_seen > saved.last_seen)`
+
+	_, err = s.db.ExecContext(ctx, updateQuery, name.UserID, name.Name)
+	return err
+}
+
+func (s *sqlStore) UserNames(ctx context.Context, userID int64) ([]UserName, error) {
+	query := `SELECT user_id, name, first_seen, last_seen FROM user_names WHERE user_id = $1
+ORDER BY last_seen DESC, first_seen DESC, name`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]UserName, 0)
+	for rows.Next() {
+		var name UserName
+		err = rows.Scan(&name.UserID, &name.Name, &name.FirstSeen, &name.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	// get any error encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// insertUserStats upserts the stats of a user in a match and adds the difference to the previous stats
+// to the user totals with addQuery, which takes the user id, kills, deaths, fratricide, weapon kills as JSON,
+// weapon deaths as JSON, suicides, environment deaths, PvP kills, PvP deaths, playtime, captures, caches destroyed
+// and defends.
+// It must run in a transaction to keep the totals consistent.
+func (s *sqlStore) insertUserStats(ctx context.Context, addQuery string, matchID uint32, userID int64, stats parser.PlayerStats) error {
+	var old parser.PlayerStats
+	var oldWeapons, oldDeathWeapons string
+	err := s.db.QueryRowContext(ctx, `SELECT kills, deaths, fratricide, suicides, environment_deaths, pvp_kills, pvp_deaths,
+       playtime, captures, caches_destroyed, defends, weapon_stats, death_weapon_stats
+FROM match_user_stats
+WHERE match_id = $1 AND user_id = $2`, matchID, userID).Scan(&old.Kills, &old.Deaths, &old.Fratricide, &old.Suicides,
+		&old.EnvironmentDeaths, &old.PvPKills, &old.PvPDeaths, &old.Playtime, &old.Captures, &old.CachesDestroyed,
+		&old.Defends, &oldWeapons, &oldDeathWeapons)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(oldWeapons), &old.WeaponStats)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal([]byte(oldDeathWeapons), &old.DeathWeaponStats)
+		if err != nil {
+			return err
+		}
+	}
+
+	insertQuery := `INSERT INTO match_user_stats (match_id, user_id, kills, deaths, fratricide, weapon_stats, death_weapon_stats,
+                              suicides, environment_deaths, team, pvp_kills, pvp_deaths, playtime,
+                              captures, caches_destroyed, defends) 
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+ON CONFLICT(match_id, user_id) DO UPDATE SET kills = $3, deaths = $4, fratricide = $5, weapon_stats = $6,
+                                             death_weapon_stats = $7, suicides = $8, environment_deaths = $9,
+                                             team = $10, pvp_kills = $11, pvp_deaths = $12, playtime = $13,
+                                             captures = $14, caches_destroyed = $15, defends = $16;`
+
+	_, err = s.db.ExecContext(ctx, insertQuery, matchID, userID, stats.Kills, stats.Deaths, stats.Fratricide, stats.WeaponStats,
+		stats.DeathWeaponStats, stats.Suicides, stats.EnvironmentDeaths, stats.Team, stats.PvPKills, stats.PvPDeaths,
+		stats.Playtime, stats.Captures, stats.CachesDestroyed, stats.Defends)
+	if err != nil {
+		return err
+	}
+
+	weaponsJSON, err := weaponStatsDelta(stats.WeaponStats, old.WeaponStats)
+	if err != nil {
+		return err
+	}
+	deathWeaponsJSON, err := weaponStatsDelta(stats.DeathWeaponStats, old.DeathWeaponStats)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, addQuery, userID, int64(stats.Kills)-int64(old.Kills), int64(stats.Deaths)-int64(old.Deaths),
+		int64(stats.Fratricide)-int64(old.Fratricide), weaponsJSON, deathWeaponsJSON,
+		int64(stats.Suicides)-int64(old.Suicides), int64(stats.EnvironmentDeaths)-int64(old.EnvironmentDeaths),
+		int64(stats.PvPKills)-int64(old.PvPKills), int64(stats.PvPDeaths)-int64(old.PvPDeaths),
+		int64(stats.Playtime)-int64(old.Playtime), int64(stats.Captures)-int64(old.Captures),
+		int64(stats.CachesDestroyed)-int64(old.CachesDestroyed), int64(stats.Defends)-int64(old.Defends))
+
+	return err
+}
+
+// weaponStatsDelta returns stats minus old as JSON, without weapons which didn't change
+func weaponStatsDelta(stats, old parser.WeaponStats) (string, error) {
+	weapons := make(map[string]int64)
+	for weapon, kills := range stats {
+		weapons[weapon] += int64(kills)
+	}
+	for weapon, kills := range old {
+		weapons[weapon] -= int64(kills)
+	}
+	for weapon, kills := range weapons {
+		if kills == 0 {
+			delete(weapons, weapon)
+		}
+	}
+
+	weaponsJSON, err := json.Marshal(weapons)
+	if err != nil {
+		return "", err
+	}
+
+	return string(weaponsJSON), nil
+}
+
+func (s *sqlStore) SaveRound(ctx context.Context, matchID uint32, round RoundStats) error {
+	upsertQuery := `INSERT INTO match_rounds (match_id, number, started_at, ended_at, winner, player_stats)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT(match_id, number) DO UPDATE SET started_at = $3, ended_at = $4, winner = $5, player_stats = $6`
+
+	playerStats, err := json.Marshal(round.Players)
+	if err != nil {
+		return err
+	}
+	endedAt := sql.NullInt64{Int64: int64(round.Round.EndedAt), Valid: round.Round.EndedAt != 0}
+	winner := sql.NullString{String: round.Round.Winner, Valid: len(round.Round.Winner) > 0}
+
+	_, err = s.db.ExecContext(ctx, upsertQuery, matchID, round.Round.Number, round.Round.StartedAt, endedAt, winner,
+		string(playerStats))
+	return err
+}
+
+func (s *sqlStore) SaveKills(ctx context.Context, matchID uint32, kills []KillEvent) error {
+	insertQuery := `INSERT INTO kill_events (match_id, seq, time, attacker_id, attacker_name, attacker_team, attacker_bot,
+                         victim_id, victim_name, victim_team, victim_bot, weapon)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT(match_id, seq) DO NOTHING`
+
+	for _, kill := range kills {
+		k := kill.Kill
+		attackerID := sql.NullInt64{Int64: int64(kill.AttackerID), Valid: kill.AttackerID != 0}
+		victimID := sql.NullInt64{Int64: int64(kill.VictimID), Valid: kill.VictimID != 0}
+		_, err := s.db.ExecContext(ctx, insertQuery, matchID, k.Seq, k.Time,
+			attackerID, k.Attacker.Name, k.Attacker.Team, k.Attacker.IsBot(),
+			victimID, k.Victim.Name, k.Victim.Team, k.Victim.IsBot(), k.Weapon)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStore) SaveSession(ctx context.Context, matchID uint32, session Session) error {
+	upsertQuery := `INSERT INTO match_sessions (match_id, user_id, joined_at, left_at, reason)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT(match_id, user_id, joined_at) DO UPDATE SET left_at = $4, reason = $5`
+
+	leftAt := sql.NullInt64{Int64: int64(session.Session.LeftAt), Valid: session.Session.LeftAt != 0}
+	reason := sql.NullString{String: session.Session.Reason, Valid: len(session.Session.Reason) > 0}
+
+	_, err := s.db.ExecContext(ctx, upsertQuery, matchID, session.UserID, session.Session.JoinedAt, leftAt, reason)
+	return err
+}
+
+func (s *sqlStore) SaveChat(ctx context.Context, matchID uint32, messages []ChatMessage) error {
+	insertQuery := `INSERT INTO chat_messages (match_id, seq, time, user_id, steam_id, name, team, team_only, text)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT(match_id, seq) DO NOTHING`
+
+	for _, message := range messages {
+		m := message.Message
+		userID := sql.NullInt64{Int64: int64(message.UserID), Valid: message.UserID != 0}
+		_, err := s.db.ExecContext(ctx, insertQuery, matchID, m.Seq, m.Time, userID, m.SteamID, m.Name, m.Team, m.TeamOnly,
+			m.Text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// searchChat runs SearchChat with like, the case insensitive LIKE operator of the dialect.
+// The filters are cast, postgres would take them for int4 from the 0 they are compared with.
+func (s *sqlStore) searchChat(ctx context.Context, like string, filter ChatFilter) ([]ChatMessage, error) {
+	query := `SELECT match_id, seq, time, user_id, steam_id, name, team, team_only, text
+FROM chat_messages
+WHERE (CAST($1 AS BIGINT) = 0 OR user_id = CAST($1 AS BIGINT))
+  AND (CAST($2 AS BIGINT) = 0 OR match_id = CAST($2 AS BIGINT))
+  AND text ` + like + ` $3 ESCAPE '\'
+ORDER BY time DESC, match_id DESC, seq DESC
+LIMIT $4`
+
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(filter.Text) + "%"
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	rows, err := s.db.QueryContext(ctx, query, filter.UserID, filter.MatchID, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]ChatMessage, 0)
+	for rows.Next() {
+		var message ChatMessage
+		var userID sql.NullInt64
+		m := &message.Message
+		err = rows.Scan(&message.MatchID, &m.Seq, &m.Time, &userID, &m.SteamID, &m.Name, &m.Team, &m.TeamOnly, &m.Text)
+		if err != nil {
+			return nil, err
+		}
+		message.UserID = userID.Int64
+		messages = append(messages, message)
+	}
+
+	// get any error encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (s *sqlStore) UsersByObjective(ctx context.Context, medal int, objective Objective, min uint32) ([]int64, error) {
+	// the column is one of the constants, it can't be a parameter
+	switch objective {
+	case ObjectiveCaptures, ObjectiveCachesDestroyed, ObjectiveDefends:
+	default:
+		return nil, fmt.Errorf("unknown objective %q", objective)
+	}
+
+	query := `
+SELECT users.id
+from users
+         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
+WHERE um.user_id IS NULL
+  AND users.` + string(objective) + ` >= $2
+`
+
+	return s.queryIDs(ctx, query, medal, min)
+}
+
+func (s *sqlStore) UsersByWins(ctx context.Context, medal int, min uint32) ([]int64, error) {
+	query := `
+SELECT users.id
+from users
+         LEFT JOIN match_user_stats mus on users.id = mus.user_id
+         LEFT JOIN matches m on mus.match_id = m.id
+         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
+WHERE m.won = true
+  AND um.user_id IS NULL
+group by users.id
+HAVING COUNT(*) >= $2
+`
+
+	return s.queryIDs(ctx, query, medal, min)
+}
+
+func (s *sqlStore) DeathlessWins(ctx context.Context, minKills uint32) ([]UserValue, error) {
+	query := `
+select id, MAX(max_kills)
+from (
+         SELECT users.id, mus.kills as max_kills
+         from users
+                  LEFT JOIN match_user_stats mus on users.id = mus.user_id
+                  LEFT JOIN matches m on mus.match_id = m.id
+         WHERE m.won = true
+           AND mus.deaths = 0
+           AND mus.kills > $1
+         group by users.id, mus.kills) a
+GROUP BY id
+`
+	rows, err := s.db.QueryContext(ctx, query, minKills)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userStats := make([]UserValue, 0)
+	for rows.Next() {
+		var user UserValue
+		err = rows.Scan(&user.ID, &user.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		userStats = append(userStats, user)
+	}
+
+	// get any error encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return userStats, nil
+}
+
+func (s *sqlStore) MedalValue(ctx context.Context, userID int64, medal int) (uint32, error) {
+	medalQuery := `SELECT value from user_medals where user_id = $1 AND medal_id = $2`
+
+	var value sql.NullInt64
+	err := s.db.QueryRowContext(ctx, medalQuery, userID, medal).Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+
+	return uint32(value.Int64), nil
+}
+
+func (s *sqlStore) AwardMedal(ctx context.Context, userID int64, medal int) error {
+	insertQuery := `INSERT INTO user_medals (user_id, medal_id) VALUES ($1, $2)`
+
+	_, err := s.db.ExecContext(ctx, insertQuery, userID, medal)
+	return err
+}
+
+func (s *sqlStore) SetMedalValue(ctx context.Context, userID int64, medal int, value uint32) error {
+	upsertQuery := `INSERT INTO user_medals (user_id, medal_id, value) VALUES ($1, $2, $3)
+ON CONFLICT(user_id, medal_id) DO UPDATE SET value = $3`
+
+	_, err := s.db.ExecContext(ctx, upsertQuery, userID, medal, value)
+	return err
+}
+
+func (s *sqlStore) IngestedFile(ctx context.Context, path string) (IngestedFile, error) {
+	query := `SELECT path, size, hash, byte_offset, match_id, status, parser_version, error, state, inserted_at, updated_at
+FROM ingested_files WHERE path = $1`
+
+	return s.queryIngestedFile(ctx, query, path)
+}
+
+func (s *sqlStore) ParsedFileByHash(ctx context.Context, hash string) (IngestedFile, error) {
+	query := `SELECT path, size, hash, byte_offset, match_id, status, parser_version, error, state, inserted_at, updated_at
+FROM ingested_files WHERE hash = $1 AND status = $2 LIMIT 1`
+
+	return s.queryIngestedFile(ctx, query, hash, FileStatusParsed)
+}
+
+func (s *sqlStore) queryIngestedFile(ctx context.Context, query string, args ...interface{}) (IngestedFile, error) {
+	var file IngestedFile
+	var matchID sql.NullInt64
+	var fileError, state sql.NullString
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&file.Path, &file.Size, &file.Hash, &file.Offset, &matchID, &file.Status,
+		&file.ParserVersion, &fileError, &state, &file.InsertedAt, &file.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return file, ErrNotFound
+		}
+		return file, err
+	}
+	file.MatchID = uint32(matchID.Int64)
+	file.Error = fileError.String
+	if state.Valid {
+		file.State = []byte(state.String)
+	}
+
+	return file, nil
+}
+
+func (s *sqlStore) SaveIngestedFile(ctx context.Context, file IngestedFile) error {
+	upsertQuery := `INSERT INTO ingested_files (path, size, hash, byte_offset, match_id, status, parser_version, error, state, inserted_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $10)
+ON CONFLICT(path) DO UPDATE SET size = $2, hash = $3, byte_offset = $4, match_id = $5, status = $6, parser_version = $7,
+                                error = $8, state = $9, updated_at = $10`
+
+	matchID := sql.NullInt64{Int64: int64(file.MatchID), Valid: file.MatchID != 0}
+	fileError := sql.NullString{String: file.Error, Valid: len(file.Error) > 0}
+	// string and not bytes, so it's not sent as bytea to jsonb
+	state := sql.NullString{String: string(file.State), Valid: len(file.State) > 0}
+
+	_, err := s.db.ExecContext(ctx, upsertQuery, file.Path, file.Size, file.Hash, file.Offset, matchID, file.Status, file.ParserVersion,
+		fileError, state, time.Now().Unix())
+	return err
+}
+
+func (s *sqlStore) UsersWithoutAvatar(ctx context.Context) ([]int64, error) {
+	return s.queryIDs(ctx, "SELECT id FROM users WHERE avatar_hash IS NULL")
+}
+
+func (s *sqlStore) SetAvatar(ctx context.Context, userID int64, hash string) error {
+	updateQuery := `UPDATE users SET avatar_hash = $1 WHERE id = $2`
+
+	_, err := s.db.ExecContext(ctx, updateQuery, hash, userID)
+	return err
+}
+
+func (s *sqlStore) queryIDs(ctx context.Context, query string, args ...interface{}) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	// get any error encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,149 @@
+package dbp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/j0y/insurgency-parser/parser"
+	_ "modernc.org/sqlite"
+)
+
+// SQLite is the Store for self-hosted servers without Postgres, weapon stats are kept as JSON text
+type SQLite struct {
+	sqlStore
+}
+
+// OpenSQLite opens or creates the database file, the tables are created by MigrateUp
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLite{newSQLStore(db)}, nil
+}
+
+func (s *SQLite) MigrateUp(ctx context.Context) ([]Migration, error) {
+	return s.migrateUp(ctx, "sqlite")
+}
+
+func (s *SQLite) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	return s.migrateDown(ctx, "sqlite", steps)
+}
+
+func (s *SQLite) Migrations(ctx context.Context) ([]Migration, error) {
+	return s.migrations(ctx, "sqlite")
+}
+
+func (s *SQLite) InTx(ctx context.Context, fn func(tx Store) error) error {
+	return s.inTx(ctx, func(tx sqlStore) Store { return &SQLite{tx} }, fn)
+}
+
+// sqliteAddUserStats adds the difference of match stats to the user totals, see insertUserStats
+const sqliteAddUserStats = `UPDATE users
+SET kills            = kills + $2,
+    deaths           = deaths + $3,
+    fratricide       = fratricide + $4,
+    suicides         = suicides + $7,
+    environment_deaths = environment_deaths + $8,
+    pvp_kills        = pvp_kills + $9,
+    pvp_deaths       = pvp_deaths + $10,
+    playtime         = playtime + $11,
+    captures         = captures + $12,
+    caches_destroyed = caches_destroyed + $13,
+    defends          = defends + $14,
+    kd               = CASE
+                           WHEN kills + $2 <= 100 THEN kd
+                           WHEN deaths + $3 = 0 THEN 9999
+                           ELSE round(cast(kills + $2 as real) / (deaths + $3), 2) END,
+    all_weapon_stats = (SELECT json_group_object(k, total)
+                        FROM (SELECT key AS k, sum(value) AS total
+                              FROM (SELECT key, value FROM json_each(all_weapon_stats)
+                                    UNION ALL
+                                    SELECT key, value FROM json_each($5))
+                              GROUP BY key
+                              HAVING sum(value) != 0)),
+    all_death_weapon_stats = (SELECT json_group_object(k, total)
+                              FROM (SELECT key AS k, sum(value) AS total
+                                    FROM (SELECT key, value FROM json_each(all_death_weapon_stats)
+                                          UNION ALL
+                                          SELECT key, value FROM json_each($6))
+                                    GROUP BY key
+                                    HAVING sum(value) != 0))
+WHERE id = $1`
+
+func (s *SQLite) InsertUserStats(ctx context.Context, matchID uint32, userID int64, stats parser.PlayerStats) error {
+	return s.insertUserStats(ctx, sqliteAddUserStats, matchID, userID, stats)
+}
+
+func (s *SQLite) RebuildUserAggregates(ctx context.Context) error {
+	totals := `update users
+set kills = a.kills, deaths = a.deaths, fratricide = a.fratricide, suicides = a.suicides,
+    environment_deaths = a.environment_deaths, pvp_kills = a.pvp_kills, pvp_deaths = a.pvp_deaths,
+    playtime = a.playtime, captures = a.captures, caches_destroyed = a.caches_destroyed, defends = a.defends
+    from (select user_id, sum(kills) as kills, sum(deaths) as deaths, sum(fratricide) as fratricide,
+                 sum(suicides) as suicides, sum(environment_deaths) as environment_deaths,
+                 sum(pvp_kills) as pvp_kills, sum(pvp_deaths) as pvp_deaths, sum(playtime) as playtime,
+                 sum(captures) as captures, sum(caches_destroyed) as caches_destroyed, sum(defends) as defends
+          from match_user_stats group by user_id) a
+WHERE users.id = a.user_id;`
+
+	kd := `update users
+set kd = round(cast(kills as real)/deaths, 2)
+where kills > 100 and deaths != 0;`
+
+	kdmax := `update users
+set kd = 9999
+where kills > 100 and deaths = 0`
+
+	allWeaponStats := `update users set all_weapon_stats = stats.agg from (
+select user_id, json_group_object(k, val) as agg
+from (
+         select user_id, j.key as k, sum(j.value) as val
+         from match_user_stats, json_each(weapon_stats) j
+         group by user_id, j.key
+     ) tt
+group by user_id) stats
+where user_id = id`
+
+	allDeathWeaponStats := `update users set all_death_weapon_stats = stats.agg from (
+select user_id, json_group_object(k, val) as agg
+from (
+         select user_id, j.key as k, sum(j.value) as val
+         from match_user_stats, json_each(death_weapon_stats) j
+         group by user_id, j.key
+     ) tt
+group by user_id) stats
+where user_id = id`
+
+	for _, query := range []string{totals, kd, kdmax, allWeaponStats, allDeathWeaponStats} {
+		_, err := s.db.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SearchChat ignores the case of ASCII letters only, see LIKE in the SQLite documentation
+func (s *SQLite) SearchChat(ctx context.Context, filter ChatFilter) ([]ChatMessage, error) {
+	return s.searchChat(ctx, "LIKE", filter)
+}
+
+func (s *SQLite) UsersByWeaponKills(ctx context.Context, medal int, weapons []string, min uint32) ([]int64, error) {
+	query := `
+SELECT users.id
+from users
+         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
+WHERE um.user_id IS NULL
+  AND (SELECT COALESCE(SUM(json_extract(all_weapon_stats, '$."' || w.value || '"')), 0) FROM json_each($2) w) >= $3
+`
+
+	weaponsJSON, err := json.Marshal(weapons)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.queryIDs(ctx, query, medal, string(weaponsJSON), min)
+}
@@ -0,0 +1,78 @@
+package dbp
+
+import (
+	"context"
+	"github.com/j0y/insurgency-parser/parser"
+	"reflect"
+	"testing"
+)
+
+func TestSQLiteUserTotals(t *testing.T) {
+	ctx := context.Background()
+	s := testSQLite(t)
+	writeMatches(t, ctx, s,
+		testMatch{info: testMatchInfo(1, true), players: map[int64]parser.PlayerStats{
+			1: {Name: "Alice", Kills: 60, Deaths: 3, WeaponStats: parser.WeaponStats{"akm": 50, "m67": 10}},
+			2: {Name: "Bob", Kills: 101},
+		}},
+		testMatch{info: testMatchInfo(2, false), players: map[int64]parser.PlayerStats{
+			1: {Name: "Alice", Kills: 50, Fratricide: 1, WeaponStats: parser.WeaponStats{"akm": 50}},
+		}},
+	)
+
+	tests := []struct {
+		userID         int64
+		kills          uint32
+		deaths         uint32
+		fratricide     uint32
+		kd             float64
+		allWeaponStats string
+	}{
+		{userID: 1, kills: 110, deaths: 3, fratricide: 1, kd: 36.67, allWeaponStats: `{"akm":100,"m67":10}`},
+		// without deaths
+		{userID: 2, kills: 101, kd: 9999, allWeaponStats: `{}`},
+	}
+	for _, test := range tests {
+		var kills, deaths, fratricide uint32
+		var kd float64
+		var allWeaponStats string
+		err := s.db.QueryRowContext(ctx, `SELECT kills, deaths, fratricide, kd, all_weapon_stats FROM users WHERE id = $1`,
+			test.userID).Scan(&kills, &deaths, &fratricide, &kd, &allWeaponStats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kills != test.kills || deaths != test.deaths || fratricide != test.fratricide || kd != test.kd ||
+			allWeaponStats != test.allWeaponStats {
+			t.Errorf("got user %d with kills %d, deaths %d, fratricide %d, kd %v and weapons %s, want %+v",
+				test.userID, kills, deaths, fratricide, kd, allWeaponStats, test)
+		}
+	}
+}
+
+func TestSQLiteSessions(t *testing.T) {
+	ctx := context.Background()
+	s := testSQLite(t)
+	matchIDs := writeMatches(t, ctx, s, testMatch{info: testMatchInfo(1, false), players: map[int64]parser.PlayerStats{
+		1: {Name: "Alice"},
+	}})
+
+	// the session is written when the player joins and again when the player leaves
+	sessions := []parser.Session{
+		{SteamID: "STEAM_1:0:1", Name: "Alice", JoinedAt: 100},
+		{SteamID: "STEAM_1:0:1", Name: "Alice", JoinedAt: 100, LeftAt: 400, Reason: "Disconnect"},
+		{SteamID: "STEAM_1:0:1", Name: "Alice", JoinedAt: 500},
+		{SteamID: "STEAM_1:0:1", Name: "Alice", JoinedAt: 500, LeftAt: 600},
+	}
+	for _, session := range sessions {
+		err := s.SaveSession(ctx, matchIDs[0], Session{Session: session, UserID: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := queryRows(t, ctx, s.db, `SELECT user_id, joined_at, left_at, reason FROM match_sessions ORDER BY joined_at`)
+	want := []string{"1 100 400 Disconnect", "1 500 600 <nil>"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got sessions %q, want %q", got, want)
+	}
+}
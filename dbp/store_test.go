@@ -0,0 +1,575 @@
+package dbp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/j0y/insurgency-parser/parser"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testStores returns empty stores of every kind the tests run against
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	return map[string]Store{"memory": NewMemory(), "sqlite": testSQLite(t)}
+}
+
+// testSQLite creates a migrated SQLite database which is removed after the test
+func testSQLite(t *testing.T) *SQLite {
+	t.Helper()
+	store, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	_, err = store.MigrateUp(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+// testMatch is a match with the stats of its players
+type testMatch struct {
+	info     parser.MatchInfo
+	players  map[int64]parser.PlayerStats
+	sessions []Session
+	names    []UserName
+}
+
+// writeMatches writes the matches like the ingestion does
+func writeMatches(t *testing.T, ctx context.Context, store Store, matches ...testMatch) []uint32 {
+	t.Helper()
+	ids := make([]uint32, 0, len(matches))
+	for _, match := range matches {
+		matchID, err := store.GetOrCreateMatchID(ctx, match.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for userID, stats := range match.players {
+			err = store.CheckOrCreateUser(ctx, userID, stats.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.InsertUserStats(ctx, matchID, userID, stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, session := range match.sessions {
+			err = store.SaveSession(ctx, matchID, session)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range match.names {
+			err = store.CheckOrCreateUser(ctx, name.UserID, name.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.SaveUserName(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, matchID)
+	}
+
+	return ids
+}
+
+// testMatchInfo returns a match on the test server which started at startedAt
+func testMatchInfo(startedAt uint64, won bool) parser.MatchInfo {
+	return parser.MatchInfo{Map: "market", StartedAt: startedAt, Duration: 600, Won: won, Ip: "1.2.3.4"}
+}
+
+func TestUsersByWeaponKills(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		weapons []string
+		min     uint32
+		want    []int64
+	}{
+		{name: "sum of the weapons", weapons: []string{"akm", "aks74u"}, min: 5, want: []int64{1, 2}},
+		{name: "weapon listed twice", weapons: []string{"aks74u", "aks74u"}, min: 4, want: []int64{1}},
+		{name: "not enough kills", weapons: []string{"akm"}, min: 4, want: []int64{2}},
+		{name: "unknown weapon", weapons: []string{"mosin"}, min: 1, want: []int64{}},
+	}
+
+	for name, store := range testStores(t) {
+		writeMatches(t, ctx, store,
+			testMatch{info: testMatchInfo(1, true), players: map[int64]parser.PlayerStats{
+				1: {Name: "Alice", Kills: 5, WeaponStats: parser.WeaponStats{"akm": 3, "aks74u": 2}},
+				2: {Name: "Bob", Kills: 5, WeaponStats: parser.WeaponStats{"akm": 5}},
+				3: {Name: "Carol", Kills: 10, WeaponStats: parser.WeaponStats{"akm": 10}},
+			}},
+		)
+		// users with the medal are left out
+		err := store.AwardMedal(ctx, 3, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			t.Run(name+"/"+test.name, func(t *testing.T) {
+				ids, err := store.UsersByWeaponKills(ctx, 1, test.weapons, test.min)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the order of the users is up to the store
+				if ids = sortIDs(ids); !reflect.DeepEqual(ids, test.want) {
+					t.Errorf("got users %v, want %v", ids, test.want)
+				}
+			})
+		}
+	}
+}
+
+func TestUsersByWins(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		min  uint32
+		want []int64
+	}{
+		{name: "one win", min: 1, want: []int64{1, 2}},
+		{name: "two wins", min: 2, want: []int64{1}},
+		{name: "lost matches don't count", min: 3, want: []int64{}},
+	}
+
+	for name, store := range testStores(t) {
+		stats := parser.PlayerStats{Name: "player", Kills: 1}
+		writeMatches(t, ctx, store,
+			testMatch{info: testMatchInfo(1, true), players: map[int64]parser.PlayerStats{1: stats, 2: stats, 3: stats}},
+			testMatch{info: testMatchInfo(2, true), players: map[int64]parser.PlayerStats{1: stats, 3: stats}},
+			testMatch{info: testMatchInfo(3, false), players: map[int64]parser.PlayerStats{1: stats, 2: stats}},
+		)
+		err := store.AwardMedal(ctx, 3, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			t.Run(name+"/"+test.name, func(t *testing.T) {
+				ids, err := store.UsersByWins(ctx, 1, test.min)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the order of the users is up to the store
+				if ids = sortIDs(ids); !reflect.DeepEqual(ids, test.want) {
+					t.Errorf("got users %v, want %v", ids, test.want)
+				}
+			})
+		}
+	}
+}
+
+func TestUsersByObjective(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		objective Objective
+		min       uint32
+		want      []int64
+	}{
+		{name: "captures", objective: ObjectiveCaptures, min: 3, want: []int64{1, 2}},
+		{name: "more captures", objective: ObjectiveCaptures, min: 4, want: []int64{1}},
+		{name: "caches destroyed", objective: ObjectiveCachesDestroyed, min: 1, want: []int64{2}},
+		{name: "defends", objective: ObjectiveDefends, min: 1, want: []int64{}},
+	}
+
+	for name, store := range testStores(t) {
+		writeMatches(t, ctx, store,
+			testMatch{info: testMatchInfo(1, true), players: map[int64]parser.PlayerStats{
+				1: {Name: "Alice", Captures: 2},
+				2: {Name: "Bob", Captures: 3, CachesDestroyed: 1},
+				3: {Name: "Carol", Captures: 10, CachesDestroyed: 5, Defends: 5},
+			}},
+			testMatch{info: testMatchInfo(2, false), players: map[int64]parser.PlayerStats{
+				1: {Name: "Alice", Captures: 2},
+			}},
+		)
+		// users with the medal are left out
+		err := store.AwardMedal(ctx, 3, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			t.Run(name+"/"+test.name, func(t *testing.T) {
+				ids, err := store.UsersByObjective(ctx, 1, test.objective, test.min)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the order of the users is up to the store
+				if ids = sortIDs(ids); !reflect.DeepEqual(ids, test.want) {
+					t.Errorf("got users %v, want %v", ids, test.want)
+				}
+			})
+		}
+		t.Run(name+"/unknown objective", func(t *testing.T) {
+			_, err := store.UsersByObjective(ctx, 1, "kills", 1)
+			if err == nil {
+				t.Error("got no error for an unknown objective")
+			}
+		})
+	}
+}
+
+func TestDeathlessWins(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			writeMatches(t, ctx, store,
+				testMatch{info: testMatchInfo(1, true), players: map[int64]parser.PlayerStats{
+					1: {Name: "Alice", Kills: 25},
+					// died
+					2: {Name: "Bob", Kills: 40, Deaths: 1},
+					// not more than the minimum
+					4: {Name: "Dave", Kills: 20},
+				}},
+				testMatch{info: testMatchInfo(2, true), players: map[int64]parser.PlayerStats{
+					1: {Name: "Alice", Kills: 30},
+				}},
+				testMatch{info: testMatchInfo(3, false), players: map[int64]parser.PlayerStats{
+					3: {Name: "Carol", Kills: 50},
+				}},
+			)
+
+			values, err := store.DeathlessWins(ctx, 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []UserValue{{ID: 1, Value: 30}}
+			if !reflect.DeepEqual(values, want) {
+				t.Errorf("got %+v, want %+v", values, want)
+			}
+		})
+	}
+}
+
+func TestMedalValue(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			writeMatches(t, ctx, store, testMatch{info: testMatchInfo(1, true),
+				players: map[int64]parser.PlayerStats{1: {Name: "Alice"}, 2: {Name: "Bob"}}})
+
+			_, err := store.MedalValue(ctx, 1, 1)
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("got %v before the medal was awarded, want ErrNotFound", err)
+			}
+
+			err = store.AwardMedal(ctx, 1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.SetMedalValue(ctx, 2, 1, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.SetMedalValue(ctx, 2, 1, 9)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for userID, want := range map[int64]uint32{1: 0, 2: 9} {
+				value, err := store.MedalValue(ctx, userID, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if value != want {
+					t.Errorf("got value %d of user %d, want %d", value, userID, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestedFiles(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.IngestedFile(ctx, "logs/1.log")
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("got %v for an unknown file, want ErrNotFound", err)
+			}
+
+			matchIDs := writeMatches(t, ctx, store, testMatch{info: testMatchInfo(1, true)})
+			files := []IngestedFile{
+				{Path: "logs/1.log", Size: 10, Hash: "a", Offset: 10, Status: FileStatusParsing, ParserVersion: 1},
+				{Path: "logs/1.log", Size: 20, Hash: "b", Offset: 20, MatchID: matchIDs[0], Status: FileStatusParsed,
+					ParserVersion: 1},
+				{Path: "logs/2.log", Size: 5, Hash: "c", Status: FileStatusFailed, ParserVersion: 1, Error: "no ip"},
+			}
+			for _, file := range files {
+				err = store.SaveIngestedFile(ctx, file)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, want := range files[1:] {
+				file, err := store.IngestedFile(ctx, want.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if file.InsertedAt == 0 || file.UpdatedAt < file.InsertedAt {
+					t.Errorf("got timestamps %d and %d of %s", file.InsertedAt, file.UpdatedAt, want.Path)
+				}
+				file.InsertedAt, file.UpdatedAt = 0, 0
+				if !reflect.DeepEqual(file, want) {
+					t.Errorf("got %+v, want %+v", file, want)
+				}
+			}
+
+			file, err := store.ParsedFileByHash(ctx, "b")
+			if err != nil || file.Path != "logs/1.log" {
+				t.Errorf("got %+v, %v by hash, want logs/1.log", file, err)
+			}
+			// only parsed files count
+			for _, hash := range []string{"a", "c"} {
+				_, err = store.ParsedFileByHash(ctx, hash)
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("got %v by hash %s, want ErrNotFound", err, hash)
+				}
+			}
+		})
+	}
+}
+
+func TestInTxRollback(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			writeMatches(t, ctx, store, testMatch{info: testMatchInfo(1, true), players: map[int64]parser.PlayerStats{
+				1: {Name: "Alice", Kills: 5, WeaponStats: parser.WeaponStats{"akm": 5}},
+			}})
+
+			failed := errors.New("failed")
+			err := store.InTx(ctx, func(tx Store) error {
+				// the match of the last write is written again with more kills
+				matchIDs := writeMatches(t, ctx, tx,
+					testMatch{info: testMatchInfo(1, true), players: map[int64]parser.PlayerStats{
+						1: {Name: "Alice", Kills: 9, WeaponStats: parser.WeaponStats{"akm": 9}},
+					}},
+					testMatch{info: testMatchInfo(2, true), players: map[int64]parser.PlayerStats{
+						1: {Name: "Alice", Kills: 7, WeaponStats: parser.WeaponStats{"akm": 7}},
+						2: {Name: "Bob", Kills: 7, WeaponStats: parser.WeaponStats{"akm": 7}},
+					}},
+				)
+				err := tx.AwardMedal(ctx, 1, 1)
+				if err != nil {
+					return err
+				}
+				err = tx.SaveIngestedFile(ctx, IngestedFile{Path: "logs/1.log", MatchID: matchIDs[1], Status: FileStatusParsed})
+				if err != nil {
+					return err
+				}
+				// transactions started in a transaction are part of it
+				err = tx.InTx(ctx, func(tx Store) error {
+					return tx.SetAvatar(ctx, 1, "hash")
+				})
+				if err != nil {
+					return err
+				}
+
+				return failed
+			})
+			if !errors.Is(err, failed) {
+				t.Fatalf("got error %v, want %v", err, failed)
+			}
+
+			ids, err := store.UsersByWeaponKills(ctx, 2, []string{"akm"}, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, []int64{1}) {
+				t.Errorf("got users %v with 5 akm kills after rollback, want [1]", ids)
+			}
+			ids, err = store.UsersByWeaponKills(ctx, 2, []string{"akm"}, 6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != 0 {
+				t.Errorf("got users %v with 6 akm kills after rollback", ids)
+			}
+			ids, err = store.UsersWithoutAvatar(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, []int64{1}) {
+				t.Errorf("got users %v without avatar after rollback, want [1]", ids)
+			}
+			if _, err = store.MedalValue(ctx, 1, 1); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v for the medal after rollback, want ErrNotFound", err)
+			}
+			if _, err = store.IngestedFile(ctx, "logs/1.log"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v for the ledger entry after rollback, want ErrNotFound", err)
+			}
+
+			// the store is usable after rollback
+			writeMatches(t, ctx, store, testMatch{info: testMatchInfo(2, true), players: map[int64]parser.PlayerStats{
+				2: {Name: "Bob", Kills: 7, WeaponStats: parser.WeaponStats{"akm": 7}},
+			}})
+			ids, err = store.UsersByWins(ctx, 1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids = sortIDs(ids); !reflect.DeepEqual(ids, []int64{1, 2}) {
+				t.Errorf("got users %v with a win, want [1 2]", ids)
+			}
+		})
+	}
+}
+
+// userTotals prints the totals of every user in the store
+func userTotals(t *testing.T, ctx context.Context, store Store) []string {
+	t.Helper()
+	switch s := store.(type) {
+	case *Memory:
+		ids := make([]int64, 0, len(s.users))
+		for id := range s.users {
+			ids = append(ids, id)
+		}
+		totals := make([]string, 0, len(ids))
+		for _, id := range sortIDs(ids) {
+			totals = append(totals, fmt.Sprintf("%d %+v", id, *s.users[id]))
+		}
+		return totals
+	case *SQLite:
+		return queryRows(t, ctx, s.db, `SELECT id, name, kills, deaths, pvp_kills, pvp_deaths, playtime, captures, caches_destroyed,
+       defends, fratricide, suicides, environment_deaths, kd, all_weapon_stats, all_death_weapon_stats
+FROM users ORDER BY id`)
+	}
+	t.Fatalf("can't read totals of %T", store)
+
+	return nil
+}
+
+func TestUserTotalsMatchRebuild(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			matchIDs := writeMatches(t, ctx, store,
+				testMatch{info: testMatchInfo(1, true), players: map[int64]parser.PlayerStats{
+					1: {Name: "Alice", Kills: 60, Deaths: 2, WeaponStats: parser.WeaponStats{"akm": 50, "m67": 10},
+						DeathWeaponStats: parser.WeaponStats{"rpk": 2}},
+					2: {Name: "Bob", Kills: 3, PvPKills: 2, PvPDeaths: 1, Playtime: 600, Captures: 2, Defends: 1,
+						WeaponStats: parser.WeaponStats{"m16a4": 3}},
+				}},
+				testMatch{info: testMatchInfo(2, false), players: map[int64]parser.PlayerStats{
+					1: {Name: "Alice", Kills: 30, Fratricide: 1, Suicides: 2, EnvironmentDeaths: 1,
+						WeaponStats: parser.WeaponStats{"akm": 30}},
+				}},
+			)
+
+			// the same matches parsed further replace their stats, m67 and rpk are gone from the first one
+			writes := []struct {
+				matchID uint32
+				userID  int64
+				stats   parser.PlayerStats
+			}{
+				{matchIDs[0], 1, parser.PlayerStats{Kills: 80, Deaths: 3, WeaponStats: parser.WeaponStats{"akm": 80},
+					DeathWeaponStats: parser.WeaponStats{"akm": 3}}},
+				{matchIDs[1], 2, parser.PlayerStats{Kills: 1, Playtime: 300, CachesDestroyed: 1,
+					WeaponStats: parser.WeaponStats{"c4": 1}}},
+				{matchIDs[1], 1, parser.PlayerStats{Kills: 40, Fratricide: 1, Suicides: 3,
+					WeaponStats: parser.WeaponStats{"akm": 35, "mk2": 5}}},
+			}
+			for _, w := range writes {
+				err := store.InsertUserStats(ctx, w.matchID, w.userID, w.stats)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deltas := userTotals(t, ctx, store)
+			err := store.RebuildUserAggregates(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rebuilt := userTotals(t, ctx, store); !reflect.DeepEqual(deltas, rebuilt) {
+				t.Errorf("totals from deltas %q differ from rebuilt %q", deltas, rebuilt)
+			}
+
+			ids, err := store.UsersByWeaponKills(ctx, 1, []string{"akm", "mk2"}, 120)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, []int64{1}) {
+				t.Errorf("got users %v with 120 kills, want [1]", ids)
+			}
+		})
+	}
+}
+
+// userName returns the current name of the user
+func userName(t *testing.T, ctx context.Context, store Store, userID int64) string {
+	t.Helper()
+	switch s := store.(type) {
+	case *Memory:
+		return s.users[userID].Name
+	case *SQLite:
+		var name string
+		err := s.db.QueryRowContext(ctx, `SELECT name FROM users WHERE id = $1`, userID).Scan(&name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	t.Fatalf("can't read the name of %T", store)
+
+	return ""
+}
+
+func TestUserNames(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// created before the history was recorded
+			err := store.CheckOrCreateUser(ctx, 1, "Old")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			steps := []struct {
+				name     UserName
+				wantName string
+			}{
+				{UserName{UserID: 1, Name: "Old"}, "Old"},
+				{UserName{UserID: 1, Name: "Alice", FirstSeen: 100, LastSeen: 200}, "Alice"},
+				{UserName{UserID: 1, Name: "Old", FirstSeen: 300, LastSeen: 400}, "Old"},
+				// seen earlier than the name used last, a match parsed late
+				{UserName{UserID: 1, Name: "Alice", FirstSeen: 50, LastSeen: 150}, "Old"},
+				{UserName{UserID: 1, Name: "Alice", FirstSeen: 450, LastSeen: 500}, "Alice"},
+			}
+			for _, step := range steps {
+				err = store.SaveUserName(ctx, step.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := userName(t, ctx, store, 1); got != step.wantName {
+					t.Errorf("got name %q after %+v, want %q", got, step.name, step.wantName)
+				}
+			}
+
+			names, err := store.UserNames(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []UserName{
+				{UserID: 1, Name: "Alice", FirstSeen: 50, LastSeen: 500},
+				{UserID: 1, Name: "Old", FirstSeen: 300, LastSeen: 400},
+			}
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("got names %+v, want %+v", names, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/j0y/insurgency-parser/dbp"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// followCommand polls logs for new lines and writes kills, deaths and rounds as soon as they appear
+// until ctx is done, unlike the run loop the state of unfinished files is kept in memory between polls.
+// It's saved in the ledger when a match ends, every state-interval and on stop, a restart continues from there.
+func followCommand(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("follow", flag.ExitOnError)
+	dir := flags.String("dir", "logs", "directory with log files")
+	interval := flags.Duration("interval", 2*time.Second, "how often files are checked for new lines")
+	usersInterval := flags.Duration("users-interval", 5*time.Minute, "how often users totals, medals and avatars are updated")
+	stateInterval := flags.Duration("state-interval", time.Minute, "how often the state of unfinished files is saved in the ledger")
+	_ = flags.Parse(args)
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	files := make(map[string]*fileState)
+	var usersUpdatedAt time.Time
+
+	for {
+		_ = filepath.Walk(*dir,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					log.Printf("can't read %s: %v\n", path, err)
+					return nil
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				if filepath.Ext(path) != ".log" {
+					return nil
+				}
+
+				if isParsed(path) {
+					return nil
+				}
+
+				file, ok := files[path]
+				if ok && info.Size() == file.offset {
+					return nil
+				}
+
+				if !ok {
+					var status string
+					err := retry(ctx, path, func() error {
+						var err error
+						status, err = checkLedger(ctx, store, path, info)
+						return err
+					})
+					if err != nil {
+						if ctx.Err() == nil {
+							log.Printf("can't check %s in the ledger: %v\n", path, err)
+						}
+						return nil
+					}
+					switch status {
+					case dbp.FileStatusParsed:
+						markParsed(path)
+						return nil
+					case dbp.FileStatusQuarantined:
+						// looked at again when it grows
+						files[path] = &fileState{offset: info.Size(), failed: true}
+						return nil
+					}
+				}
+
+				err = retry(ctx, path, func() error {
+					if file == nil || info.Size() < file.offset || file.failed {
+						// new, truncated or failed file, or the previous attempt failed
+						var err error
+						file, err = loadFileState(ctx, store, path, info)
+						if err != nil {
+							return err
+						}
+						files[path] = file
+					}
+
+					err := followFile(ctx, store, path, info, file, *stateInterval)
+					if err != nil {
+						// the parser is ahead of the ledger now
+						file.failed = true
+					}
+					return err
+				})
+				if err != nil {
+					recordFailure(ctx, store, path, info, err)
+					// continued from the ledger when it grows
+					files[path] = &fileState{offset: info.Size(), failed: true}
+					return nil
+				}
+				if file.parser.Result().Match.Duration > 0 {
+					delete(files, path)
+					markParsed(path)
+				}
+
+				return nil
+			})
+		if ctx.Err() != nil {
+			saveFollowed(store, files)
+			log.Println("stopped")
+			return
+		}
+
+		if time.Since(usersUpdatedAt) >= *usersInterval {
+			updateUsers(ctx, store)
+			usersUpdatedAt = time.Now()
+		}
+
+		if !sleep(ctx, *interval) {
+			saveFollowed(store, files)
+			log.Println("stopped")
+			return
+		}
+	}
+}
+
+// followFile parses the new lines of the file, its progress is saved only when a match ended
+// or stateInterval passed since it was saved last time
+func followFile(ctx context.Context, store dbp.Store, pathFilename string, info os.FileInfo, file *fileState,
+	stateInterval time.Duration) error {
+	parsed, err := parseNewLines(ctx, store, pathFilename, file)
+	if err != nil || !parsed {
+		return err
+	}
+
+	if file.matchID == file.savedMatchID && file.parser.Result().Match.Duration == 0 &&
+		time.Since(file.savedAt) < stateInterval {
+		return nil
+	}
+
+	return saveProgress(ctx, store, pathFilename, info, file)
+}
+
+// saveFollowed saves the progress of the followed files on stop, it isn't cancelled with the command.
+// Failed files are left as they are, they were interrupted and continue from their last saved progress.
+func saveFollowed(store dbp.Store, files map[string]*fileState) {
+	for path, file := range files {
+		if file.failed || (file.matchID == file.savedMatchID && file.offset == file.savedOffset) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("failed to save the progress of %s: %v\n", path, err)
+			continue
+		}
+		err = saveProgress(context.Background(), store, path, info, file)
+		if err != nil {
+			log.Printf("failed to save the progress of %s: %v\n", path, err)
+		}
+	}
+}
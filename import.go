@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/j0y/insurgency-parser/dbp"
+	"github.com/j0y/insurgency-parser/medals"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// importCommand parses files from the given paths in parallel and loads them in batches,
+// with COPY when the store supports it. When ctx is done the batch being loaded is rolled back.
+func importCommand(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	batchSize := flags.Int("batch", 500, "files loaded in one transaction")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: import [flags] [file or directory...]\n\nParses logs/ when no path is given.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"logs"}
+	}
+
+	workers, err := parseWorkers()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	files := make(chan logFile)
+	parsed := make(chan dbp.BulkFile)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range files {
+				bulkFile, ok := importFile(ctx, store, file.path, file.info)
+				if ok {
+					parsed <- bulkFile
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for _, root := range paths {
+			_ = filepath.Walk(root,
+				func(path string, info os.FileInfo, err error) error {
+					if err != nil {
+						log.Printf("can't read %s: %v\n", path, err)
+						return nil
+					}
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+
+					if info.IsDir() || filepath.Ext(path) != ".log" {
+						return nil
+					}
+
+					files <- logFile{path: path, info: info}
+
+					return nil
+				})
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		close(files)
+		wg.Wait()
+		close(parsed)
+	}()
+
+	batch := make([]dbp.BulkFile, 0, *batchSize)
+	imported := 0
+	for file := range parsed {
+		if ctx.Err() != nil {
+			// drained so the workers can stop
+			continue
+		}
+
+		batch = append(batch, file)
+		if len(batch) < *batchSize {
+			continue
+		}
+
+		err = retry(ctx, "import", func() error {
+			return loadFiles(ctx, store, batch)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			log.Fatal(err)
+		}
+		imported += len(batch)
+		log.Printf("imported %d files\n", imported)
+		batch = batch[:0]
+	}
+
+	if ctx.Err() != nil {
+		log.Printf("stopped after %d files\n", imported)
+		return
+	}
+
+	err = retry(ctx, "import", func() error {
+		return loadFiles(ctx, store, batch)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	imported += len(batch)
+	log.Printf("imported %d files\n", imported)
+
+	err = retry(ctx, "medals", func() error {
+		return medals.UpdateMedals(ctx, store)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// importFile parses the file without writing it, it returns false when the file was parsed before or failed
+func importFile(ctx context.Context, store dbp.Store, pathFilename string, info os.FileInfo) (dbp.BulkFile, bool) {
+	var bulkFile dbp.BulkFile
+
+	var status string
+	err := retry(ctx, pathFilename, func() error {
+		var err error
+		status, err = checkLedger(ctx, store, pathFilename, info)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("can't check %s in the ledger: %v\n", pathFilename, err)
+		}
+		return bulkFile, false
+	}
+	if status != "" {
+		return bulkFile, false
+	}
+
+	err = retry(ctx, pathFilename, func() error {
+		file, err := loadFileState(ctx, store, pathFilename, info)
+		if err != nil {
+			return err
+		}
+		bulkFile, err = parseForImport(ctx, pathFilename, info, file)
+		return err
+	})
+	if err != nil {
+		recordFailure(ctx, store, pathFilename, info, err)
+		return bulkFile, false
+	}
+
+	return bulkFile, true
+}
+
+func parseForImport(ctx context.Context, pathFilename string, info os.FileInfo, file *fileState) (dbp.BulkFile, error) {
+	var bulkFile dbp.BulkFile
+
+	_, err := readNewLines(ctx, pathFilename, file)
+	if err != nil {
+		return bulkFile, err
+	}
+
+	for _, changes := range file.parser.TakeChanges() {
+		match, err := matchStats(changes)
+		if err != nil {
+			return bulkFile, err
+		}
+		bulkFile.Matches = append(bulkFile.Matches, match)
+	}
+
+	bulkFile.Ingested, err = file.ledgerEntry(pathFilename, info)
+	if err != nil {
+		return bulkFile, err
+	}
+	if current := file.parser.Result().Match; len(current.Map) > 0 {
+		bulkFile.LastMatch = current
+	}
+
+	return bulkFile, nil
+}
+
+// loadFiles writes parsed files with BulkLoad, or match by match when the store can't load in bulk.
+// Either way the files are loaded in a single transaction.
+func loadFiles(ctx context.Context, store dbp.Store, files []dbp.BulkFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	if loader, ok := store.(dbp.BulkLoader); ok {
+		return loader.BulkLoad(ctx, files)
+	}
+
+	return store.InTx(ctx, func(tx dbp.Store) error {
+		for _, file := range files {
+			for _, match := range file.Matches {
+				matchID, err := writeMatch(ctx, tx, match)
+				if err != nil {
+					return err
+				}
+				file.Ingested.MatchID = matchID
+			}
+
+			err := tx.SaveIngestedFile(ctx, file.Ingested)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
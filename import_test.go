@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/j0y/insurgency-parser/dbp"
+	"github.com/j0y/insurgency-parser/parser"
+	"path/filepath"
+	"testing"
+)
+
+// failingStore fails to create matches on the map, its transactions are failing stores too
+type failingStore struct {
+	dbp.Store
+	failingMap string
+}
+
+var errFailingMap = errors.New("failing map")
+
+func (s failingStore) InTx(ctx context.Context, fn func(tx dbp.Store) error) error {
+	return s.Store.InTx(ctx, func(tx dbp.Store) error {
+		return fn(failingStore{Store: tx, failingMap: s.failingMap})
+	})
+}
+
+func (s failingStore) GetOrCreateMatchID(ctx context.Context, matchInfo parser.MatchInfo) (uint32, error) {
+	if matchInfo.Map == s.failingMap {
+		return 0, errFailingMap
+	}
+	return s.Store.GetOrCreateMatchID(ctx, matchInfo)
+}
+
+func TestLoadFilesFallbackIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := dbp.OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	_, err = sqlite.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	market := parser.MatchInfo{Map: "market", StartedAt: 1, Duration: 600, Ip: "1.2.3.4"}
+	sinjar := parser.MatchInfo{Map: "sinjar", StartedAt: 2, Duration: 600, Ip: "1.2.3.4"}
+	alice := map[int64]parser.PlayerStats{1: {Name: "Alice", Kills: 5}}
+	files := []dbp.BulkFile{
+		{
+			Ingested:  dbp.IngestedFile{Path: "logs/1.log", Status: dbp.FileStatusParsed},
+			Matches:   []dbp.MatchStats{{Match: market, Players: alice}},
+			LastMatch: market,
+		},
+		{
+			Ingested:  dbp.IngestedFile{Path: "logs/2.log", Status: dbp.FileStatusParsed},
+			Matches:   []dbp.MatchStats{{Match: sinjar, Players: alice}},
+			LastMatch: sinjar,
+		},
+	}
+
+	for name, store := range map[string]dbp.Store{"memory": dbp.NewMemory(), "sqlite": sqlite} {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := store.(dbp.BulkLoader); ok {
+				t.Fatal("the store loads in bulk, the fallback isn't tested")
+			}
+
+			err := loadFiles(ctx, failingStore{Store: store, failingMap: "sinjar"}, files)
+			if !errors.Is(err, errFailingMap) {
+				t.Fatalf("got error %v, want %v", err, errFailingMap)
+			}
+
+			// the first file was written before the second one failed
+			if _, err = store.IngestedFile(ctx, "logs/1.log"); !errors.Is(err, dbp.ErrNotFound) {
+				t.Errorf("got %v for the first file, want ErrNotFound", err)
+			}
+			users, err := store.UsersWithoutAvatar(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 0 {
+				t.Errorf("got users %v of the failed batch", users)
+			}
+
+			err = loadFiles(ctx, store, files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range files {
+				ingested, err := store.IngestedFile(ctx, file.Ingested.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ingested.MatchID == 0 {
+					t.Errorf("got %+v without match", ingested)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/j0y/insurgency-parser/dbp"
+	"github.com/j0y/insurgency-parser/parser"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// checkLedger returns the status of a file which doesn't have to be parsed now, or an empty string.
+// Failed files are tried again on every pass, unfinished ones only when they grew
+// and quarantined ones when they changed or the parser was updated.
+// Files missing in the ledger are recorded as parsed when they have a legacy .parsed marker
+// or the same content as a parsed file, which happens when logs are moved.
+func checkLedger(ctx context.Context, store dbp.Store, pathFilename string, info os.FileInfo) (string, error) {
+	ingested, err := store.IngestedFile(ctx, pathFilename)
+	if err == nil {
+		switch ingested.Status {
+		case dbp.FileStatusParsed:
+			return ingested.Status, nil
+		case dbp.FileStatusParsing, dbp.FileStatusSkipped:
+			if ingested.Size == info.Size() {
+				return ingested.Status, nil
+			}
+		case dbp.FileStatusQuarantined:
+			if ingested.Size == info.Size() && ingested.ParserVersion == parser.Version {
+				return ingested.Status, nil
+			}
+		}
+		return "", nil
+	}
+	if !errors.Is(err, dbp.ErrNotFound) {
+		return "", err
+	}
+
+	_, err = os.Stat(pathFilename + ".parsed")
+	legacyParsed := !errors.Is(err, os.ErrNotExist)
+	if !legacyParsed && info.Size() == 0 {
+		// just created, every empty file has the same hash
+		return "", nil
+	}
+
+	hash, size, err := hashFile(pathFilename)
+	if err != nil {
+		return "", err
+	}
+
+	ingested = dbp.IngestedFile{Path: pathFilename, Size: size, Hash: hash, Offset: size, Status: dbp.FileStatusParsed}
+
+	if !legacyParsed {
+		parsed, err := store.ParsedFileByHash(ctx, hash)
+		if err != nil {
+			if errors.Is(err, dbp.ErrNotFound) {
+				return "", nil
+			}
+			return "", err
+		}
+		ingested.MatchID = parsed.MatchID
+		ingested.ParserVersion = parsed.ParserVersion
+	}
+
+	err = store.SaveIngestedFile(ctx, ingested)
+	if err != nil {
+		return "", err
+	}
+
+	return ingested.Status, nil
+}
+
+func hashFile(pathFilename string) (string, int64, error) {
+	file, err := os.Open(pathFilename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// fileState is what is needed to continue parsing a log from where the previous pass stopped
+type fileState struct {
+	// offset of the first byte which wasn't parsed yet, always at the start of a line
+	offset int64
+	// hash of the parsed bytes
+	hash    hash.Hash
+	parser  *parser.Parser
+	matchID uint32
+	// failed files are parsed again from the last saved progress when they grow
+	failed bool
+
+	// match, offset and time of the last saveProgress call
+	savedMatchID uint32
+	savedOffset  int64
+	savedAt      time.Time
+}
+
+// savedState is the fileState kept in the ledger between passes
+type savedState struct {
+	Hash   []byte          `json:"hash"`
+	Parser json.RawMessage `json:"parser"`
+}
+
+// loadFileState continues from the ledger entry of an unfinished, failed or quarantined file, when it was written
+// by the same parser version and the file didn't shrink since, otherwise the file is parsed from the start
+func loadFileState(ctx context.Context, store dbp.Store, pathFilename string, info os.FileInfo) (*fileState, error) {
+	ip, err := parser.IPFromFilename(pathFilename)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	opts := parser.Options{Ip: ip, Errors: os.Stderr}
+
+	file := &fileState{hash: sha256.New(), parser: parser.New(opts)}
+
+	ingested, err := store.IngestedFile(ctx, pathFilename)
+	if err != nil {
+		if errors.Is(err, dbp.ErrNotFound) {
+			return file, nil
+		}
+		return nil, err
+	}
+
+	if ingested.ParserVersion != parser.Version || len(ingested.State) == 0 || info.Size() < ingested.Offset ||
+		ingested.Status == dbp.FileStatusParsed {
+		return file, nil
+	}
+
+	var saved savedState
+	err = json.Unmarshal(ingested.State, &saved)
+	if err != nil {
+		log.Printf("can't resume %s, parsing from the start: %v\n", pathFilename, err)
+		return file, nil
+	}
+
+	p, err := parser.Restore(opts, saved.Parser)
+	if err != nil {
+		log.Printf("can't resume %s, parsing from the start: %v\n", pathFilename, err)
+		return file, nil
+	}
+
+	h := sha256.New()
+	err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(saved.Hash)
+	if err != nil {
+		log.Printf("can't resume %s, parsing from the start: %v\n", pathFilename, err)
+		return file, nil
+	}
+
+	return &fileState{offset: ingested.Offset, hash: h, parser: p, matchID: ingested.MatchID,
+		savedMatchID: ingested.MatchID, savedOffset: ingested.Offset, savedAt: time.Now()}, nil
+}
+
+func (f *fileState) save() ([]byte, error) {
+	var saved savedState
+	var err error
+
+	saved.Hash, err = f.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	saved.Parser, err = f.parser.State()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(saved)
+}
+
+// parseNewLines parses complete lines added since the last call and writes the players whose stats changed,
+// it returns false when there were no new lines. The progress is recorded in the ledger by saveProgress.
+func parseNewLines(ctx context.Context, store dbp.Store, pathFilename string, file *fileState) (bool, error) {
+	parsed, err := readNewLines(ctx, pathFilename, file)
+	if err != nil || !parsed {
+		return false, err
+	}
+
+	for _, changes := range file.parser.TakeChanges() {
+		file.matchID, err = saveMatch(ctx, store, changes)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// readNewLines parses complete lines added since the last call, it returns false when there were none
+func readNewLines(ctx context.Context, pathFilename string, file *fileState) (bool, error) {
+	f, err := os.Open(pathFilename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(file.offset, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+
+	start := file.offset
+	r := bufio.NewReader(f)
+	for {
+		// nothing is written until the whole file is read, so it's safe to stop anywhere
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// the last line is still being written, it's read again next time
+				break
+			}
+			return false, err
+		}
+
+		file.parser.ParseLine(line)
+		file.offset += int64(len(line))
+		file.hash.Write([]byte(line))
+	}
+
+	return file.offset > start, nil
+}
+
+// saveProgress records in the ledger how far the file was parsed
+func saveProgress(ctx context.Context, store dbp.Store, pathFilename string, info os.FileInfo, file *fileState) error {
+	ingested, err := file.ledgerEntry(pathFilename, info)
+	if err != nil {
+		return err
+	}
+	if ingested.Status == dbp.FileStatusParsed {
+		fmt.Println("Finished processing match ", file.matchID)
+	}
+
+	err = store.SaveIngestedFile(ctx, ingested)
+	if err != nil {
+		return err
+	}
+	file.savedMatchID = file.matchID
+	file.savedOffset = file.offset
+	file.savedAt = time.Now()
+
+	return nil
+}
+
+// ledgerEntry describes the progress of the file, the state is included when it has to be parsed again
+func (f *fileState) ledgerEntry(pathFilename string, info os.FileInfo) (dbp.IngestedFile, error) {
+	ingested := dbp.IngestedFile{
+		Path:          pathFilename,
+		Size:          info.Size(),
+		Hash:          hex.EncodeToString(f.hash.Sum(nil)),
+		Offset:        f.offset,
+		MatchID:       f.matchID,
+		Status:        dbp.FileStatusParsing,
+		ParserVersion: parser.Version,
+	}
+
+	current := f.parser.Result().Match
+	switch {
+	case len(current.Map) == 0:
+		ingested.Status = dbp.FileStatusSkipped
+	case current.Duration > 0:
+		ingested.Status = dbp.FileStatusParsed
+	}
+
+	if ingested.Status != dbp.FileStatusParsed {
+		var err error
+		ingested.State, err = f.save()
+		if err != nil {
+			return ingested, err
+		}
+	}
+
+	return ingested, nil
+}
+
+// recordFailure marks the file as failed in the ledger, or quarantined when the error is permanent.
+// The offset, hash and state saved by the last successful pass are kept, so the next attempt continues
+// from there. Nothing is recorded when ctx is done, the file is continued after restart.
+func recordFailure(ctx context.Context, store dbp.Store, pathFilename string, info os.FileInfo, cause error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	status := dbp.FileStatusFailed
+	if isPermanent(cause) {
+		status = dbp.FileStatusQuarantined
+	}
+	log.Printf("failed to parse %s, %s: %v\n", pathFilename, status, cause)
+
+	err := retry(ctx, pathFilename, func() error {
+		ingested, err := store.IngestedFile(ctx, pathFilename)
+		if err != nil && !errors.Is(err, dbp.ErrNotFound) {
+			return err
+		}
+		if ingested.ParserVersion != parser.Version {
+			// the progress of another version can't be continued
+			ingested = dbp.IngestedFile{ParserVersion: parser.Version}
+		}
+		ingested.Path = pathFilename
+		ingested.Size = info.Size()
+		ingested.Status = status
+		ingested.Error = cause.Error()
+
+		return store.SaveIngestedFile(ctx, ingested)
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("can't record the failure of %s: %v\n", pathFilename, err)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/j0y/insurgency-parser/dbp"
+	"github.com/j0y/insurgency-parser/steamid"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	loadMarket = `Loading map "market"`
+	aliceKills = `"Alice<2><STEAM_1:0:12345><#Team_Security>" killed "Bot<5><BOT><#Team_Insurgent>" with "akm<12>" at (1.0, 2.0, 3.0)`
+	roundWin   = `Team "#Team_Security" triggered "Round_Win"`
+	lost       = `Team "#Team_Insurgent" triggered "Round_Win"`
+)
+
+// writeLog writes the messages one minute apart to a log file of the server 1.2.3.4 in dir
+func writeLog(t *testing.T, dir string, name string, messages ...string) (string, os.FileInfo) {
+	t.Helper()
+	var log strings.Builder
+	for i, message := range messages {
+		fmt.Fprintf(&log, "L 04/19/2022 - 20:%02d:00: %s\n", i, message)
+	}
+
+	pathFilename := filepath.Join(dir, "1.2.3.4_27015_"+name+".log")
+	err := os.WriteFile(pathFilename, []byte(log.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(pathFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pathFilename, info
+}
+
+func TestParseFileStatus(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name       string
+		messages   []string
+		wantStatus string
+		wantMatch  bool
+	}{
+		{name: "no map", messages: []string{aliceKills}, wantStatus: dbp.FileStatusSkipped},
+		{name: "match not over", messages: []string{loadMarket, aliceKills}, wantStatus: dbp.FileStatusParsing, wantMatch: true},
+		{name: "match over", messages: []string{loadMarket, aliceKills, roundWin, lost}, wantStatus: dbp.FileStatusParsed,
+			wantMatch: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := dbp.NewMemory()
+			pathFilename, info := writeLog(t, t.TempDir(), "1", test.messages...)
+
+			parseFile(ctx, store, pathFilename, info)
+
+			ingested, err := store.IngestedFile(ctx, pathFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ingested.Status != test.wantStatus || ingested.Offset != info.Size() || len(ingested.Hash) == 0 ||
+				(ingested.MatchID != 0) != test.wantMatch {
+				t.Errorf("got %+v, want status %s at offset %d", ingested, test.wantStatus, info.Size())
+			}
+
+			// a file is parsed again only when it grows
+			status, err := checkLedger(ctx, store, pathFilename, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != test.wantStatus {
+				t.Errorf("got ledger status %q, want %q", status, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCheckLedger(t *testing.T) {
+	ctx := context.Background()
+	store := dbp.NewMemory()
+	dir := t.TempDir()
+	messages := []string{loadMarket, aliceKills, roundWin, lost}
+
+	parsed, info := writeLog(t, dir, "1", messages...)
+	parseFile(ctx, store, parsed, info)
+	want, err := store.IngestedFile(ctx, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same content at another path
+	moved, info := writeLog(t, t.TempDir(), "1", messages...)
+	status, err := checkLedger(ctx, store, moved, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != dbp.FileStatusParsed {
+		t.Errorf("got status %q of a moved file, want parsed", status)
+	}
+	ingested, err := store.IngestedFile(ctx, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ingested.MatchID != want.MatchID || ingested.Hash != want.Hash {
+		t.Errorf("got %+v of a moved file, want match %d and hash %s", ingested, want.MatchID, want.Hash)
+	}
+
+	// marked by older versions
+	legacy, info := writeLog(t, dir, "2", loadMarket, aliceKills)
+	err = os.WriteFile(legacy+".parsed", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err = checkLedger(ctx, store, legacy, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != dbp.FileStatusParsed {
+		t.Errorf("got status %q of a file with a .parsed marker, want parsed", status)
+	}
+
+	// new content
+	unknown, info := writeLog(t, dir, "3", loadMarket)
+	status, err = checkLedger(ctx, store, unknown, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "" {
+		t.Errorf("got status %q of a new file, want it to be parsed", status)
+	}
+}
+
+// akmKillers returns the users with at least min akm kills
+func akmKillers(t *testing.T, ctx context.Context, store dbp.Store, min uint32) []int64 {
+	t.Helper()
+	ids, err := store.UsersByWeaponKills(ctx, 1, []string{"akm"}, min)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ids
+}
+
+func TestParseFileResumes(t *testing.T) {
+	ctx := context.Background()
+	messages := []string{loadMarket, aliceKills, aliceKills, roundWin, lost}
+	aliceID, err := steamid.Parse("STEAM_1:0:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for stop := 1; stop < len(messages); stop++ {
+		store := dbp.NewMemory()
+		dir := t.TempDir()
+		pathFilename, info := writeLog(t, dir, "1", messages[:stop]...)
+		parseFile(ctx, store, pathFilename, info)
+		before, err := store.IngestedFile(ctx, pathFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the progress is kept when the next pass fails
+		recordFailure(ctx, store, pathFilename, info, errors.New("connection refused"))
+		failed, err := store.IngestedFile(ctx, pathFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed.Status != dbp.FileStatusFailed || failed.Error != "connection refused" || failed.Offset != before.Offset ||
+			failed.Hash != before.Hash || failed.MatchID != before.MatchID || !bytes.Equal(failed.State, before.State) {
+			t.Errorf("stopped after line %d: got %+v after the failure, want the progress of %+v", stop, failed, before)
+		}
+
+		pathFilename, info = writeLog(t, dir, "1", messages...)
+		parseFile(ctx, store, pathFilename, info)
+
+		ingested, err := store.IngestedFile(ctx, pathFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, _, err := hashFile(pathFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ingested.Status != dbp.FileStatusParsed || ingested.Offset != info.Size() || ingested.Hash != hash {
+			t.Errorf("stopped after line %d: got %+v, want parsed at offset %d with hash %s", stop, ingested,
+				info.Size(), hash)
+		}
+		if ids := akmKillers(t, ctx, store, 2); !reflect.DeepEqual(ids, []int64{aliceID}) {
+			t.Errorf("stopped after line %d: got users %v with 2 akm kills, want %d", stop, ids, aliceID)
+		}
+		if ids := akmKillers(t, ctx, store, 3); len(ids) != 0 {
+			t.Errorf("stopped after line %d: got users %v with 3 akm kills", stop, ids)
+		}
+	}
+}
+
+func TestFollowFileSavesState(t *testing.T) {
+	ctx := context.Background()
+	messages := []string{loadMarket, aliceKills, aliceKills, `Loading map "sinjar"`, aliceKills, aliceKills, roundWin, lost}
+	steps := []struct {
+		name string
+		// lines is the number of lines written so far
+		lines         int
+		stateInterval time.Duration
+		wantStatus    string
+		wantLines     int
+	}{
+		{name: "match started", lines: 2, stateInterval: time.Hour, wantStatus: dbp.FileStatusParsing, wantLines: 2},
+		{name: "kill", lines: 3, stateInterval: time.Hour, wantStatus: dbp.FileStatusParsing, wantLines: 2},
+		{name: "next map", lines: 5, stateInterval: time.Hour, wantStatus: dbp.FileStatusParsing, wantLines: 5},
+		{name: "interval passed", lines: 6, stateInterval: 0, wantStatus: dbp.FileStatusParsing, wantLines: 6},
+		{name: "match over", lines: 8, stateInterval: time.Hour, wantStatus: dbp.FileStatusParsed, wantLines: 8},
+	}
+
+	store := dbp.NewMemory()
+	dir := t.TempDir()
+	pathFilename, info := writeLog(t, dir, "1")
+	file, err := loadFileState(ctx, store, pathFilename, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range steps {
+		pathFilename, info = writeLog(t, dir, "1", messages[:step.lines]...)
+		err = followFile(ctx, store, pathFilename, info, file, step.stateInterval)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, wantInfo := writeLog(t, t.TempDir(), "1", messages[:step.wantLines]...)
+		ingested, err := store.IngestedFile(ctx, pathFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ingested.Status != step.wantStatus || ingested.Offset != wantInfo.Size() {
+			t.Errorf("%s: got status %s at offset %d, want %s at %d", step.name, ingested.Status, ingested.Offset,
+				step.wantStatus, wantInfo.Size())
+		}
+	}
+}
+
+func TestSaveFollowedOnStop(t *testing.T) {
+	ctx := context.Background()
+	store := dbp.NewMemory()
+	dir := t.TempDir()
+	pathFilename, info := writeLog(t, dir, "1", loadMarket, aliceKills)
+	file, err := loadFileState(ctx, store, pathFilename, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = followFile(ctx, store, pathFilename, info, file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the kill isn't saved until the interval passes or the command stops
+	pathFilename, info = writeLog(t, dir, "1", loadMarket, aliceKills, aliceKills)
+	err = followFile(ctx, store, pathFilename, info, file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failedPath, failedInfo := writeLog(t, dir, "2", loadMarket)
+	files := map[string]*fileState{
+		pathFilename: file,
+		failedPath:   {offset: failedInfo.Size(), failed: true},
+	}
+	saveFollowed(store, files)
+
+	ingested, err := store.IngestedFile(ctx, pathFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ingested.Offset != info.Size() {
+		t.Errorf("got offset %d after stop, want %d", ingested.Offset, info.Size())
+	}
+	if _, err = store.IngestedFile(ctx, failedPath); !errors.Is(err, dbp.ErrNotFound) {
+		t.Errorf("got %v for a failed file, want it left as it was", err)
+	}
+}
+
+func TestRecordFailureStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		cause      error
+		wantStatus string
+		// wantLedger is the status checkLedger returns while the file doesn't change
+		wantLedger string
+	}{
+		{name: "transient", cause: errors.New("connection refused"), wantStatus: dbp.FileStatusFailed},
+		{name: "permanent", cause: permanent(errors.New("malformed SteamID")), wantStatus: dbp.FileStatusQuarantined,
+			wantLedger: dbp.FileStatusQuarantined},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := dbp.NewMemory()
+			dir := t.TempDir()
+			pathFilename, info := writeLog(t, dir, "1", loadMarket, aliceKills)
+
+			recordFailure(ctx, store, pathFilename, info, test.cause)
+			ingested, err := store.IngestedFile(ctx, pathFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ingested.Status != test.wantStatus || ingested.Error != test.cause.Error() {
+				t.Errorf("got %+v, want status %s", ingested, test.wantStatus)
+			}
+
+			status, err := checkLedger(ctx, store, pathFilename, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != test.wantLedger {
+				t.Errorf("got ledger status %q, want %q", status, test.wantLedger)
+			}
+
+			// every file is tried again when it changes
+			pathFilename, info = writeLog(t, dir, "1", loadMarket, aliceKills, aliceKills)
+			status, err = checkLedger(ctx, store, pathFilename, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != "" {
+				t.Errorf("got ledger status %q of a changed file, want it to be parsed", status)
+			}
+		})
+	}
+}
+
+func TestParseFileQuarantinesFileWithoutIp(t *testing.T) {
+	ctx := context.Background()
+	store := dbp.NewMemory()
+	pathFilename := filepath.Join(t.TempDir(), "server.log")
+	err := os.WriteFile(pathFilename, []byte("L 04/19/2022 - 20:00:00: "+loadMarket+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(pathFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parseFile(ctx, store, pathFilename, info)
+
+	ingested, err := store.IngestedFile(ctx, pathFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ingested.Status != dbp.FileStatusQuarantined {
+		t.Errorf("got %+v, want it quarantined", ingested)
+	}
+}
@@ -1,413 +1,625 @@
 package main
 
 import (
-	"bufio"
-	"database/sql"
-	"database/sql/driver"
-	"encoding/json"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"github.com/MrWaggel/gosteamconv"
-	insurgencylog "github.com/j0y/insurgency-log"
 	"github.com/j0y/insurgency-parser/avatars"
 	"github.com/j0y/insurgency-parser/dbp"
 	"github.com/j0y/insurgency-parser/medals"
+	"github.com/j0y/insurgency-parser/parser"
+	"github.com/j0y/insurgency-parser/steamid"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
-type matchInfoStruct struct {
-	Map       string `json:"map"`
-	Rounds    uint8  `json:"rounds"`
-	StartedAt uint64 `json:"started_at"`
-	Duration  uint32 `json:"duration"`
-	Won       bool   `json:"won"`
-	Ip        string `json:"ip"`
-}
+// parsedFiles caches files which are parsed according to the ledger, so it isn't queried for them again
+var parsedFiles = make(map[string]struct{})
+var parsedFilesMu sync.Mutex
 
-type weaponStatsStruct map[string]uint32
+func isParsed(path string) bool {
+	parsedFilesMu.Lock()
+	defer parsedFilesMu.Unlock()
 
-type playerStatsStruct struct {
-	Name        string            `json:"name"`
-	Kills       uint32            `json:"kills"`
-	Deaths      uint32            `json:"deaths"`
-	Fratricide  uint32            `json:"fratricide"`
-	WeaponStats weaponStatsStruct `json:"weapon_stats"`
+	_, ok := parsedFiles[path]
+	return ok
 }
 
-// Value Returns the JSON-encoded representation
-func (a weaponStatsStruct) Value() (driver.Value, error) {
-	if len(a) == 0 {
-		return "{}", nil
-	}
-	return json.Marshal(a)
+func markParsed(path string) {
+	parsedFilesMu.Lock()
+	defer parsedFilesMu.Unlock()
+
+	parsedFiles[path] = struct{}{}
 }
 
-var parsedFiles = make(map[string]struct{})
+// logFile is a file found in logs, waiting for a parse worker
+type logFile struct {
+	path string
+	info os.FileInfo
+}
 
 func main() {
 	err := godotenv.Load()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatal(err)
+	}
+
+	flag.Usage = usage
+	flag.Parse()
+
+	// the current transaction is rolled back on SIGINT or SIGTERM, a second signal kills the process right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	switch command := flag.Arg(0); command {
+	case "", "run":
+		run(ctx)
+	case "parse":
+		parseCommand(ctx, flag.Args()[1:])
+	case "follow":
+		followCommand(ctx, flag.Args()[1:])
+	case "import":
+		importCommand(ctx, flag.Args()[1:])
+	case "chat":
+		chatCommand(ctx, flag.Args()[1:])
+	case "names":
+		namesCommand(ctx, flag.Args()[1:])
+	case "rebuild-aggregates":
+		rebuildAggregates(ctx)
+	case "migrate":
+		migrateCommand(ctx, flag.Args()[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [command]
+
+Commands:
+  run                      parse new files in logs/ every 5 minutes (default)
+  parse [flags] <file|->   parse a single log file or stdin, see parse -h
+  follow [flags]           tail growing files in logs/ and update matches live, see follow -h
+  import [flags] [path...] backfill archived logs in batches, see import -h
+  chat [flags]             search chat messages by player, match or text, see chat -h
+  names [flags] <player>   list the names a player used by SteamID, see names -h
+  rebuild-aggregates       recompute users totals from all match stats
+  migrate [flags] <action> apply (up), revert (down) or list (status) schema migrations
+`, filepath.Base(os.Args[0]))
+}
+
+// run is the ingestion loop, it parses every new file in logs and updates users stats until ctx is done
+func run(ctx context.Context) {
+	store, err := openStore()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer store.Close()
 
-	dbp.DB, err = sql.Open("postgres", os.Getenv("PSQL_CONN"))
+	workers, err := parseWorkers()
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	defer dbp.DB.Close()
 
 	for {
-		err := filepath.Walk("logs",
+		files := make(chan logFile)
+		var wg sync.WaitGroup
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for file := range files {
+					processFile(ctx, store, file.path, file.info)
+				}
+			}()
+		}
+
+		_ = filepath.Walk("logs",
 			func(path string, info os.FileInfo, err error) error {
 				if err != nil {
-					return err
+					log.Printf("can't read %s: %v\n", path, err)
+					return nil
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
 				}
 
 				if filepath.Ext(path) != ".log" {
 					return nil
 				}
 
-				if _, ok := parsedFiles[path]; ok {
+				if isParsed(path) {
 					return nil
 				}
 
-				if _, err := os.Stat(path + ".parsed"); errors.Is(err, os.ErrNotExist) {
-					// file does not exist
-					parseFile(path)
-				} else {
-					parsedFiles[path] = struct{}{}
-				}
+				files <- logFile{path: path, info: info}
 
 				return nil
 			})
-		if err != nil {
-			log.Fatal(err)
+		close(files)
+		wg.Wait()
+		if ctx.Err() != nil {
+			log.Println("stopped")
+			return
+		}
+
+		updateUsers(ctx, store)
+
+		if !sleep(ctx, 5*time.Minute) {
+			log.Println("stopped")
+			return
 		}
+	}
+}
 
-		runUserAllScoreUpdate()
-		medals.UpdateMedals()
-		updateAvatars()
+// sleep waits for d, it returns false when ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-		time.Sleep(5 * time.Minute)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
 }
 
-func parseFile(pathFilename string) {
-	file, err := os.Open(pathFilename)
+// openStore connects to the database selected by DB_DRIVER, postgres by default.
+// SQLite databases are migrated on open, so they work without running migrate up first.
+func openStore() (dbp.Store, error) {
+	store, err := openDatabase()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	var matchInfo matchInfoStruct
-	playerStats := make(map[string]playerStatsStruct)
+	if sqlite, ok := store.(*dbp.SQLite); ok {
+		_, err = sqlite.MigrateUp(context.Background())
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
 
-	re := regexp.MustCompile(`^[0-9,.]*`)
+	return store, nil
+}
 
-	filename := filepath.Base(pathFilename)
-	ip := re.FindString(filename)
-	if len(ip) == 0 {
-		log.Fatal("ip not found")
+// openDatabase is openStore without migrations
+func openDatabase() (dbp.Store, error) {
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", "postgres":
+		return dbp.OpenPostgres(os.Getenv("PSQL_CONN"))
+	case "sqlite":
+		return dbp.OpenSQLite(os.Getenv("SQLITE_PATH"))
+	case "memory":
+		return dbp.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER: %s", driver)
 	}
-	matchInfo.Ip = ip
+}
 
-	/*if len(os.Args) < 2 {
-		file = os.Stdin
-	} else {
-		file, err = os.Open(os.Args[1])
-	}*/
+// parseWorkers returns how many files are parsed in parallel, PARSE_WORKERS or the number of CPUs
+func parseWorkers() (int, error) {
+	value := os.Getenv("PARSE_WORKERS")
+	if len(value) == 0 {
+		return runtime.NumCPU(), nil
+	}
 
-	r := bufio.NewReader(file)
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers < 1 {
+		return 0, fmt.Errorf("wrong PARSE_WORKERS: %s", value)
+	}
 
-	// read first line
-	l, _, err := r.ReadLine()
+	return workers, nil
+}
 
-	for err == nil {
-		message, errParse := insurgencylog.Parse(string(l))
-		if errParse != nil {
-			// print parse errors to stderr
-			_, err = fmt.Fprintf(os.Stderr, "ERROR: %s", insurgencylog.ToJSON(message))
-			if err != nil {
-				fmt.Println(insurgencylog.ToJSON(message))
-				fmt.Println(err)
-			}
+// processFile parses the file when the ledger says it's needed
+func processFile(ctx context.Context, store dbp.Store, path string, info os.FileInfo) {
+	var status string
+	err := retry(ctx, path, func() error {
+		var err error
+		status, err = checkLedger(ctx, store, path, info)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("can't check %s in the ledger: %v\n", path, err)
 		}
+		return
+	}
 
-		switch m := message.(type) {
-		case insurgencylog.LoadingMap:
-			matchInfo.Map = m.Map
-			matchInfo.StartedAt = getAdjustedTime(m.Time.Unix())
-		case insurgencylog.PlayerKill:
-			if m.Attacker.SteamID == insurgencylog.PlayerBot && m.Victim.SteamID != insurgencylog.PlayerBot {
-				stats := playerStats[m.Victim.SteamID]
-				if len(stats.Name) == 0 {
-					stats.Name = m.Victim.Name
-				}
-				stats.Deaths++
-				playerStats[m.Victim.SteamID] = stats
-			}
-			if m.Victim.SteamID == insurgencylog.PlayerBot && m.Attacker.SteamID != insurgencylog.PlayerBot {
-				stats := playerStats[m.Attacker.SteamID]
-				if len(stats.Name) == 0 {
-					stats.Name = m.Attacker.Name
-				}
-				stats.Kills++
+	switch status {
+	case dbp.FileStatusParsed:
+		markParsed(path)
+	case "":
+		parseFile(ctx, store, path, info)
+	}
+}
 
-				if stats.WeaponStats == nil {
-					stats.WeaponStats = make(map[string]uint32)
-				}
-				weaponStats, _ := stats.WeaponStats[m.Weapon]
-				weaponStats++
-				stats.WeaponStats[m.Weapon] = weaponStats
+// parseFile continues parsing the log from where the previous pass stopped,
+// every attempt starts again from the ledger
+func parseFile(ctx context.Context, store dbp.Store, pathFilename string, info os.FileInfo) {
+	err := retry(ctx, pathFilename, func() error {
+		return parseAndSave(ctx, store, pathFilename, info)
+	})
+	if err != nil {
+		recordFailure(ctx, store, pathFilename, info, err)
+	}
+}
 
-				playerStats[m.Attacker.SteamID] = stats
-			}
-			if m.Attacker.SteamID != insurgencylog.PlayerBot && m.Victim.SteamID != insurgencylog.PlayerBot {
-				stats := playerStats[m.Attacker.SteamID]
-				if len(stats.Name) == 0 {
-					stats.Name = m.Attacker.Name
-				}
-				stats.Fratricide++
-				playerStats[m.Attacker.SteamID] = stats
-			}
-		case insurgencylog.RoundWin:
-			if m.Team == insurgencylog.TeamSecurity {
-				matchInfo.Rounds++
-			} else if m.Team == insurgencylog.TeamInsurgent {
-				matchInfo.Won = true
-				matchInfo.Duration = uint32(getAdjustedTime(m.Time.Unix()) - matchInfo.StartedAt)
-			}
-		case insurgencylog.NextLevel:
-			if matchInfo.Duration == 0 && m.Level != "" {
-				//changing map without winning
-				matchInfo.Duration = uint32(getAdjustedTime(m.Time.Unix()) - matchInfo.StartedAt)
-			}
-		case insurgencylog.ServerMessage:
-			if m.Text == "quit" {
-				if matchInfo.Duration == 0 {
-					//changing map without winning
-					matchInfo.Duration = uint32(getAdjustedTime(m.Time.Unix()) - matchInfo.StartedAt)
-				}
-				//match over
-				break
-			}
-		}
+func parseAndSave(ctx context.Context, store dbp.Store, pathFilename string, info os.FileInfo) error {
+	file, err := loadFileState(ctx, store, pathFilename, info)
+	if err != nil {
+		return err
+	}
 
-		// next line
-		l, _, err = r.ReadLine()
+	parsed, err := parseNewLines(ctx, store, pathFilename, file)
+	if err != nil || !parsed {
+		return err
 	}
 
-	if len(matchInfo.Map) == 0 {
-		log.Printf("map is empty, skipping %s\n", filename)
-		return
+	return saveProgress(ctx, store, pathFilename, info, file)
+}
+
+// rebuildAggregates repairs users totals if they went out of sync with match stats
+func rebuildAggregates(ctx context.Context) {
+	store, err := openStore()
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer store.Close()
 
-	matchID := getOrCreateMatchID(matchInfo)
+	err = store.RebuildUserAggregates(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	for s, statsStruct := range playerStats {
-		userID, err := gosteamconv.SteamStringToInt32(s)
-		if err != nil {
-			log.Fatal(err)
+// updateUsers refreshes medals and avatars, totals are kept up to date when stats are written
+func updateUsers(ctx context.Context, store dbp.Store) {
+	err := retry(ctx, "medals", func() error {
+		return medals.UpdateMedals(ctx, store)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return
 		}
+		log.Printf("can't update medals: %v\n", err)
+	}
+	updateAvatars(ctx, store)
+}
 
-		err = checkOrCreateUser(userID, statsStruct.Name)
-		if err != nil {
-			log.Fatal(err)
-		}
+// saveMatch writes the match and stats of every player in it in one transaction
+func saveMatch(ctx context.Context, store dbp.Store, result *parser.MatchResult) (uint32, error) {
+	match, err := matchStats(result)
+	if err != nil {
+		return 0, err
+	}
 
-		err = insertUserStats(matchID, userID, statsStruct)
-		if err != nil {
-			log.Fatal(err)
-		}
+	return writeMatch(ctx, store, match)
+}
+
+// matchStats keys players of the match and its rounds by user id, players without a steam account
+// like STEAM_ID_PENDING can't be told apart and are left out, as are malformed SteamIDs which are logged.
+// Stats of a user logged with several SteamID forms are summed up, with the name and team of the form seen last.
+func matchStats(result *parser.MatchResult) (dbp.MatchStats, error) {
+	match := dbp.MatchStats{
+		Match:   result.Match,
+		Players: make(map[int64]parser.PlayerStats, len(result.Players)),
+		Rounds:  make([]dbp.RoundStats, 0, len(result.Rounds)),
 	}
 
-	if matchInfo.Duration > 0 {
-		f, err := os.Create(pathFilename + ".parsed")
-		if err != nil {
-			log.Fatal(err)
+	lastSeen := make(map[string]uint64, len(result.Names))
+	for _, name := range result.Names {
+		if name.LastSeen > lastSeen[name.SteamID] {
+			lastSeen[name.SteamID] = name.LastSeen
+		}
+	}
+	steamIDs := make([]string, 0, len(result.Players))
+	for s := range result.Players {
+		steamIDs = append(steamIDs, s)
+	}
+	sort.Slice(steamIDs, func(i, j int) bool {
+		a, b := steamIDs[i], steamIDs[j]
+		if lastSeen[a] != lastSeen[b] {
+			return lastSeen[a] < lastSeen[b]
 		}
-		err = f.Close()
+		return a < b
+	})
+
+	for _, s := range steamIDs {
+		statsStruct := result.Players[s]
+		if !parser.IsSteamID(s) {
+			if _, err := steamid.Parse(s); !errors.Is(err, steamid.ErrNoAccount) {
+				log.Printf("leaving out %s <%s> of the match on %s at %d: %v\n", statsStruct.Name, s,
+					result.Match.Map, result.Match.StartedAt, err)
+			}
+			continue
+		}
+		userID, err := userIDFromSteamID(s)
 		if err != nil {
-			log.Fatal(err)
+			return match, err
+		}
+		if total, ok := match.Players[userID]; ok {
+			statsStruct = addPlayerStats(total, statsStruct)
 		}
+		match.Players[userID] = statsStruct
 	}
 
-	fmt.Println("Finished processing match ", matchID)
-}
-
-func getOrCreateMatchID(matchInfo matchInfoStruct) uint32 {
-	selectQuery := `SELECT id from matches where ip = $1 AND started_at = $2 AND map = $3`
-	insertQuery := `INSERT INTO matches (ip, started_at, map, rounds, duration, won) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
-	updateQuery := `UPDATE matches SET rounds = $1, duration =$2, won = $3 WHERE id = $4`
-
-	var matchID uint32
-	err := dbp.DB.QueryRow(selectQuery, matchInfo.Ip, matchInfo.StartedAt, matchInfo.Map).Scan(&matchID)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			err = dbp.DB.QueryRow(insertQuery, matchInfo.Ip, matchInfo.StartedAt, matchInfo.Map, matchInfo.Rounds, matchInfo.Duration, matchInfo.Won).Scan(&matchID)
+	for _, round := range result.Rounds {
+		roundStats := dbp.RoundStats{
+			Round:   round.Round,
+			Players: make(map[int64]parser.RoundPlayerStats, len(round.Players)),
+		}
+		for s, statsStruct := range round.Players {
+			if !parser.IsSteamID(s) {
+				continue
+			}
+			userID, err := userIDFromSteamID(s)
 			if err != nil {
-				log.Fatal(err)
+				return match, err
 			}
-		} else {
-			log.Fatal(err)
+			total := roundStats.Players[userID]
+			total.Kills += statsStruct.Kills
+			total.Deaths += statsStruct.Deaths
+			total.PvPKills += statsStruct.PvPKills
+			total.PvPDeaths += statsStruct.PvPDeaths
+			roundStats.Players[userID] = total
 		}
+		match.Rounds = append(match.Rounds, roundStats)
 	}
 
-	_, err = dbp.DB.Exec(updateQuery, matchInfo.Rounds, matchInfo.Duration, matchInfo.Won, matchID)
-	if err != nil {
-		log.Fatal(err)
+	match.Kills = make([]dbp.KillEvent, 0, len(result.Kills))
+	for _, kill := range result.Kills {
+		killEvent := dbp.KillEvent{Kill: kill}
+		var err error
+		if parser.IsSteamID(kill.Attacker.SteamID) {
+			killEvent.AttackerID, err = userIDFromSteamID(kill.Attacker.SteamID)
+			if err != nil {
+				return match, err
+			}
+		}
+		if parser.IsSteamID(kill.Victim.SteamID) {
+			killEvent.VictimID, err = userIDFromSteamID(kill.Victim.SteamID)
+			if err != nil {
+				return match, err
+			}
+		}
+		match.Kills = append(match.Kills, killEvent)
 	}
 
-	return matchID
-}
-
-func checkOrCreateUser(userID int, name string) error {
-	userQuery := `SELECT 1 from users where id = $1`
-	insertQuery := `INSERT INTO users (id, name) VALUES ($1, $2)`
+	match.Sessions = make([]dbp.Session, 0, len(result.Sessions))
+	for _, session := range result.Sessions {
+		userID, err := userIDFromSteamID(session.SteamID)
+		if err != nil {
+			return match, err
+		}
+		match.Sessions = append(match.Sessions, dbp.Session{Session: session, UserID: userID})
+	}
 
-	var dummy int
-	err := dbp.DB.QueryRow(userQuery, userID).Scan(&dummy)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			_, err = dbp.DB.Exec(insertQuery, userID, name)
+	match.Chat = make([]dbp.ChatMessage, 0, len(result.Chat))
+	for _, message := range result.Chat {
+		chatMessage := dbp.ChatMessage{Message: message}
+		if parser.IsSteamID(message.SteamID) {
+			var err error
+			chatMessage.UserID, err = userIDFromSteamID(message.SteamID)
 			if err != nil {
-				return err
+				return match, err
 			}
-		} else {
-			return err
 		}
+		match.Chat = append(match.Chat, chatMessage)
+	}
+
+	match.Names = make([]dbp.UserName, 0, len(result.Names))
+	for _, name := range result.Names {
+		userID, err := userIDFromSteamID(name.SteamID)
+		if err != nil {
+			return match, err
+		}
+		match.Names = append(match.Names, dbp.UserName{UserID: userID, Name: name.Name, FirstSeen: name.FirstSeen,
+			LastSeen: name.LastSeen})
 	}
 
-	return nil
+	return match, nil
 }
 
-func insertUserStats(matchID uint32, userID int, stats playerStatsStruct) error {
-	insertQuery := `INSERT INTO match_user_stats (match_id, user_id, kills, deaths, fratricide, weapon_stats) 
-VALUES ($1, $2, $3, $4, $5, $6)
-ON CONFLICT(match_id, user_id) DO UPDATE SET kills = $3, deaths = $4, fratricide = $5, weapon_stats = $6;`
+// userIDFromSteamID returns the SteamID64 users are keyed by for STEAM_X:Y:Z, SteamID3 and SteamID64 ids
+// addPlayerStats sums up the stats of two SteamID forms of the same user, the name and team of stats win.
+// The weapon stats are summed up in new maps, the ones of the parser are left as they are.
+func addPlayerStats(total, stats parser.PlayerStats) parser.PlayerStats {
+	if len(stats.Name) > 0 {
+		total.Name = stats.Name
+	}
+	if len(stats.Team) > 0 {
+		total.Team = stats.Team
+	}
+	total.Kills += stats.Kills
+	total.Deaths += stats.Deaths
+	total.PvPKills += stats.PvPKills
+	total.PvPDeaths += stats.PvPDeaths
+	total.Fratricide += stats.Fratricide
+	total.Suicides += stats.Suicides
+	total.EnvironmentDeaths += stats.EnvironmentDeaths
+	total.WeaponStats = addWeaponStats(total.WeaponStats, stats.WeaponStats)
+	total.DeathWeaponStats = addWeaponStats(total.DeathWeaponStats, stats.DeathWeaponStats)
+	total.Playtime += stats.Playtime
+	total.Captures += stats.Captures
+	total.CachesDestroyed += stats.CachesDestroyed
+	total.Defends += stats.Defends
+
+	return total
+}
 
-	_, err := dbp.DB.Exec(insertQuery, matchID, userID, stats.Kills, stats.Deaths, stats.Fratricide, stats.WeaponStats)
-	if err != nil {
-		return err
+// addWeaponStats returns the sum of the weapon stats in a new map
+func addWeaponStats(a, b parser.WeaponStats) parser.WeaponStats {
+	sum := make(parser.WeaponStats, len(a)+len(b))
+	for weapon, kills := range a {
+		sum[weapon] += kills
+	}
+	for weapon, kills := range b {
+		sum[weapon] += kills
 	}
 
-	return nil
+	return sum
 }
 
-func runUserAllScoreUpdate() {
-	kills := `update users
-set kills = a.total
-    from (select user_id, sum(kills) as total from match_user_stats group by user_id) a
-WHERE users.id = a.user_id;`
-
-	_, err := dbp.DB.Exec(kills)
+func userIDFromSteamID(steamID string) (int64, error) {
+	userID, err := steamid.Parse(steamID)
 	if err != nil {
-		log.Fatal(err)
+		return 0, permanent(fmt.Errorf("player %s: %w", steamID, err))
 	}
 
-	deaths := `update users
-set deaths = a.total
-    from (select user_id, sum(deaths) as total from match_user_stats group by user_id) a
-WHERE users.id = a.user_id;`
+	return userID, nil
+}
 
-	_, err = dbp.DB.Exec(deaths)
-	if err != nil {
-		log.Fatal(err)
+func writeMatch(ctx context.Context, store dbp.Store, match dbp.MatchStats) (uint32, error) {
+	// users are written in the order of their ids, so concurrent matches lock their rows in the same order
+	// and can't deadlock
+	userIDs := make([]int64, 0, len(match.Players))
+	for userID := range match.Players {
+		userIDs = append(userIDs, userID)
 	}
+	sort.Slice(userIDs, func(i, j int) bool {
+		return userIDs[i] < userIDs[j]
+	})
+	// stable keeps the names of a user in the order they were seen
+	names := append([]dbp.UserName(nil), match.Names...)
+	sort.SliceStable(names, func(i, j int) bool {
+		return names[i].UserID < names[j].UserID
+	})
 
-	frats := `update users
-set fratricide = a.total
-    from (select user_id, sum(fratricide) as total from match_user_stats group by user_id) a
-WHERE users.id = a.user_id;`
+	var matchID uint32
+	err := store.InTx(ctx, func(tx dbp.Store) error {
+		var err error
+		matchID, err = tx.GetOrCreateMatchID(ctx, match.Match)
+		if err != nil {
+			return err
+		}
 
-	_, err = dbp.DB.Exec(frats)
-	if err != nil {
-		log.Fatal(err)
-	}
+		for _, userID := range userIDs {
+			statsStruct := match.Players[userID]
+			err = tx.CheckOrCreateUser(ctx, userID, statsStruct.Name)
+			if err != nil {
+				return err
+			}
 
-	kd := `update users
-set kd = cast(kills as decimal)/deaths
-where kills > 100 and deaths != 0;`
+			err = tx.InsertUserStats(ctx, matchID, userID, statsStruct)
+			if err != nil {
+				return err
+			}
+		}
 
-	_, err = dbp.DB.Exec(kd)
-	if err != nil {
-		log.Fatal(err)
-	}
+		for _, round := range match.Rounds {
+			err = tx.SaveRound(ctx, matchID, round)
+			if err != nil {
+				return err
+			}
+		}
 
-	kdmax := `update users
-set kd = 9999
-where kills > 100 and deaths = 0`
+		err = tx.SaveKills(ctx, matchID, match.Kills)
+		if err != nil {
+			return err
+		}
 
-	_, err = dbp.DB.Exec(kdmax)
-	if err != nil {
-		log.Fatal(err)
-	}
+		for _, session := range match.Sessions {
+			err = tx.SaveSession(ctx, matchID, session)
+			if err != nil {
+				return err
+			}
+		}
 
-	allWeaponStats := `update users set all_weapon_stats = stats.agg from (
-select user_id, jsonb_object_agg(k, val) as agg
-from (
-         select user_id, k, sum(v::numeric) as val
-         from match_user_stats
-                  join lateral jsonb_each_text(weapon_stats) j(k, v) on true
-         group by user_id, k
-     ) tt
-group by user_id) stats
-where user_id = id`
+		err = tx.SaveChat(ctx, matchID, match.Chat)
+		if err != nil {
+			return err
+		}
 
-	_, err = dbp.DB.Exec(allWeaponStats)
+		for _, name := range names {
+			// players who only chatted have no stats which created them
+			err = tx.CheckOrCreateUser(ctx, name.UserID, name.Name)
+			if err != nil {
+				return err
+			}
+
+			err = tx.SaveUserName(ctx, name)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-}
-
-const minute = 60
-const hour = 60 * minute
 
-func getAdjustedTime(unixtime int64) uint64 {
-	return uint64(unixtime - 10*hour)
+	return matchID, nil
 }
 
-func updateAvatars() {
-	rows, err := dbp.DB.Query("SELECT id FROM users WHERE avatar_hash IS NULL")
+func updateAvatars(ctx context.Context, store dbp.Store) {
+	var userIDs []int64
+	err := retry(ctx, "avatars", func() error {
+		var err error
+		userIDs, err = store.UsersWithoutAvatar(ctx)
+		return err
+	})
 	if err != nil {
-		panic(err)
-	}
-	defer rows.Close()
-
-	userIDs := make([]uint32, 0)
-	for rows.Next() {
-		var id uint32
-		err = rows.Scan(&id)
-		if err != nil {
-			panic(err)
+		if ctx.Err() == nil {
+			log.Printf("can't update avatars: %v\n", err)
 		}
-		userIDs = append(userIDs, id)
-	}
-	// get any error encountered during iteration
-	err = rows.Err()
-	if err != nil {
-		panic(err)
+		return
 	}
 
-	updateQuery := `UPDATE users SET avatar_hash = $1 WHERE id = $2`
-
 	for _, userID := range userIDs {
-		hash, err := avatars.GetAvatar(userID)
+		var hash string
+		err := retry(ctx, "avatar", func() error {
+			var err error
+			hash, err = avatars.GetAvatar(ctx, userID)
+			if errors.Is(err, avatars.ErrNoAvatar) {
+				return permanent(err)
+			}
+			return err
+		})
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Printf("%v", err)
+			if !isPermanent(err) {
+				// Steam is unreachable, the rest is tried on the next pass
+				return
+			}
 			continue
 		}
 
-		_, err = dbp.DB.Exec(updateQuery, hash, userID)
+		err = retry(ctx, "avatar", func() error {
+			return store.SetAvatar(ctx, userID, hash)
+		})
 		if err != nil {
-			panic(err)
+			if ctx.Err() == nil {
+				log.Printf("can't save avatar of %d: %v\n", userID, err)
+			}
+			return
 		}
 
-		time.Sleep(time.Second)
+		if !sleep(ctx, time.Second) {
+			return
+		}
 	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/j0y/insurgency-parser/parser"
+	"github.com/j0y/insurgency-parser/steamid"
+	"reflect"
+	"testing"
+)
+
+func TestMatchStatsMergesSteamIDForms(t *testing.T) {
+	aliceID, err := steamid.Parse("STEAM_1:0:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		players     map[string]parser.PlayerStats
+		names       []parser.PlayerName
+		wantPlayers map[int64]parser.PlayerStats
+	}{
+		{
+			name: "legacy and SteamID3",
+			players: map[string]parser.PlayerStats{
+				"STEAM_1:0:12345": {Name: "Alice", Team: "Security", Kills: 2, Deaths: 1, Playtime: 60,
+					WeaponStats: parser.WeaponStats{"akm": 2}, DeathWeaponStats: parser.WeaponStats{"rpk": 1}},
+				"[U:1:24690]": {Name: "Alicia", Team: "Insurgent", Kills: 3, PvPKills: 1, Captures: 1,
+					WeaponStats: parser.WeaponStats{"akm": 1, "m16a4": 2}},
+			},
+			names: []parser.PlayerName{
+				{SteamID: "STEAM_1:0:12345", Name: "Alice", FirstSeen: 100, LastSeen: 200},
+				{SteamID: "[U:1:24690]", Name: "Alicia", FirstSeen: 50, LastSeen: 300},
+			},
+			wantPlayers: map[int64]parser.PlayerStats{aliceID: {Name: "Alicia", Team: "Insurgent", Kills: 5,
+				Deaths: 1, PvPKills: 1, Playtime: 60, Captures: 1,
+				WeaponStats: parser.WeaponStats{"akm": 3, "m16a4": 2}, DeathWeaponStats: parser.WeaponStats{"rpk": 1}}},
+		},
+		{
+			name: "legacy seen last",
+			players: map[string]parser.PlayerStats{
+				"STEAM_1:0:12345":   {Name: "Alice", Team: "Security", Kills: 2},
+				"76561197960290418": {Name: "Alicia", Team: "Insurgent", Kills: 3},
+			},
+			names: []parser.PlayerName{
+				{SteamID: "STEAM_1:0:12345", Name: "Alice", FirstSeen: 100, LastSeen: 400},
+				{SteamID: "76561197960290418", Name: "Alicia", FirstSeen: 50, LastSeen: 300},
+			},
+			wantPlayers: map[int64]parser.PlayerStats{aliceID: {Name: "Alice", Team: "Security", Kills: 5,
+				WeaponStats: parser.WeaponStats{}, DeathWeaponStats: parser.WeaponStats{}}},
+		},
+		{
+			name: "without account",
+			players: map[string]parser.PlayerStats{
+				"STEAM_1:0:12345":  {Name: "Alice", Kills: 2},
+				"STEAM_ID_PENDING": {Name: "Bob", Kills: 3},
+				"STEAM_1:2:777":    {Name: "Carol", Kills: 4},
+			},
+			wantPlayers: map[int64]parser.PlayerStats{aliceID: {Name: "Alice", Kills: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := &parser.MatchResult{Players: test.players, Names: test.names, Rounds: []parser.RoundResult{
+				{Players: map[string]parser.RoundPlayerStats{
+					"STEAM_1:0:12345": {Kills: 1, Deaths: 1},
+					"[U:1:24690]":     {Kills: 2, PvPKills: 1},
+					"BOT":             {Kills: 5},
+				}},
+			}}
+			// printed before, the maps are compared by their content
+			weapons := fmt.Sprint(result.Players["STEAM_1:0:12345"].WeaponStats)
+
+			match, err := matchStats(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(match.Players, test.wantPlayers) {
+				t.Errorf("got players %+v, want %+v", match.Players, test.wantPlayers)
+			}
+			wantRound := map[int64]parser.RoundPlayerStats{aliceID: {Kills: 3, Deaths: 1, PvPKills: 1}}
+			if round := match.Rounds[0].Players; !reflect.DeepEqual(round, wantRound) {
+				t.Errorf("got round players %+v, want %+v", round, wantRound)
+			}
+			// the weapon stats of the parser are left as they are
+			if got := fmt.Sprint(result.Players["STEAM_1:0:12345"].WeaponStats); got != weapons {
+				t.Errorf("got parser weapon stats %s, want %s", got, weapons)
+			}
+		})
+	}
+}
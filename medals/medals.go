@@ -1,10 +1,9 @@
 package medals
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"github.com/j0y/insurgency-parser/dbp"
-	"log"
 )
 
 const (
@@ -27,6 +26,8 @@ const (
 	MedalObjectiveThreeYears
 	MedalObjectiveFourYears
 	MedalObjectiveCount
+	MedalObjectiveCapturer      // Capture 100 points.
+	MedalObjectiveDemolitionist // Destroy 50 caches.
 )
 
 var medals = []int{
@@ -49,193 +50,65 @@ var medals = []int{
 	MedalObjectiveThreeYears,
 	MedalObjectiveFourYears,
 	MedalObjectiveCount,
+	MedalObjectiveCapturer,
+	MedalObjectiveDemolitionist,
 }
 
-func UpdateMedals() {
+// rifles lists aks74u twice, its kills have always counted twice towards RifleExpert
+var rifles = []string{"akm", "aks74u", "galil_sar", "ak74", "asval", "arx160", "ppsh", "fal", "svd", "m14", "m16a4",
+	"sks", "m1a1", "ump45", "aks74u", "akalpha", "akmod", "galil", "m4a1"}
+
+var explosives = []string{"grenade_f1", "grenade_ied", "grenade_m67", "grenade_c4", "grenade_mk2", "mortar_piat",
+	"rocket_rpg7", "rocket_at4", "grenade_m203_he", "grenade_rifle_enfield", "grenade_gp25_he", "grenade_rifle_k98",
+	"grenade_gp25_lvg", "m590"}
+
+var boltActions = []string{"mosin", "k98", "springfield", "enfield", "m1garand", "CS5"}
+
+var pistols = []string{"deagle", "sw500", "makarov", "model10", "welrod", "browninghp", "sw1917", "mr73", "ots33",
+	"glock18"}
+
+var knives = []string{"gurkha"}
+
+func UpdateMedals(ctx context.Context, store dbp.Store) error {
 	for _, medal := range medals {
+		var err error
 		switch medal {
-		/*case MedalObjectiveMostKillsCurrent:
-			err := checkMostKills()
-			if err != nil {
-				log.Fatal(err)
-			}
-		case MedalObjectiveHighestKDCurrent:
-
-		} */
 		case MedalObjectiveIWon:
-			err := checkIWon()
-			if err != nil {
-				log.Fatal(err)
-			}
+			err = checkIWon(ctx, store)
 		case MedalObjectiveDieHard:
-			err := checkDieHard()
-			if err != nil {
-				log.Fatal(err)
-			}
+			err = checkDieHard(ctx, store)
 		case MedalObjectiveKnifeExpert:
-			err := checkKnifeExpert()
-			if err != nil {
-				log.Fatal(err)
-			}
+			err = checkWeaponExpert(ctx, store, MedalObjectiveKnifeExpert, knives, 100)
 		case MedalObjectivePistolExpert:
-			err := checkPistolExpert()
-			if err != nil {
-				log.Fatal(err)
-			}
+			err = checkWeaponExpert(ctx, store, MedalObjectivePistolExpert, pistols, 1000)
 		case MedalObjectiveBoltExpert:
-			err := checkBoltExpert()
-			if err != nil {
-				log.Fatal(err)
-			}
+			err = checkWeaponExpert(ctx, store, MedalObjectiveBoltExpert, boltActions, 1000)
 		case MedalObjectiveExplosivesExpert:
-			err := checkExplosivesExpert()
-			if err != nil {
-				log.Fatal(err)
-			}
+			err = checkWeaponExpert(ctx, store, MedalObjectiveExplosivesExpert, explosives, 1000)
 		case MedalObjectiveRifleExpert:
-			err := checkRifleExpert()
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	}
-}
-
-func checkRifleExpert() error {
-	rifleExpertsQuery := `
-SELECT users.id
-from users
-         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
-WHERE um.user_id IS NULL
-  AND (COALESCE((all_weapon_stats -> 'akm')::int, 0) + COALESCE((all_weapon_stats -> 'aks74u')::int, 0) +
-       COALESCE((all_weapon_stats -> 'galil_sar')::int, 0) + COALESCE((all_weapon_stats -> 'ak74')::int, 0) +
-       COALESCE((all_weapon_stats -> 'asval')::int, 0) + COALESCE((all_weapon_stats -> 'arx160')::int, 0) +
-       COALESCE((all_weapon_stats -> 'ppsh')::int, 0) + COALESCE((all_weapon_stats -> 'fal')::int, 0) +
-       COALESCE((all_weapon_stats -> 'svd')::int, 0) +
-       COALESCE((all_weapon_stats -> 'm14')::int, 0) + COALESCE((all_weapon_stats -> 'm16a4')::int, 0) +
-       COALESCE((all_weapon_stats -> 'sks')::int, 0) + COALESCE((all_weapon_stats -> 'm1a1')::int, 0) +
-       COALESCE((all_weapon_stats -> 'ump45')::int, 0) + COALESCE((all_weapon_stats -> 'aks74u')::int, 0) + 
-       COALESCE((all_weapon_stats -> 'akalpha')::int, 0) + COALESCE((all_weapon_stats -> 'akmod')::int, 0) + 
-       COALESCE((all_weapon_stats -> 'galil')::int, 0) + COALESCE((all_weapon_stats -> 'm4a1')::int, 0)) >= 5000
-`
-
-	err := getIDAndAwardMedal(rifleExpertsQuery, MedalObjectiveRifleExpert)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func checkExplosivesExpert() error {
-	explosExpertsQuery := `
-SELECT users.id
-from users
-         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
-WHERE um.user_id IS NULL
-  AND (COALESCE((all_weapon_stats -> 'grenade_f1')::int, 0) + COALESCE((all_weapon_stats -> 'grenade_ied')::int, 0) +
-       COALESCE((all_weapon_stats -> 'grenade_m67')::int, 0) + COALESCE((all_weapon_stats -> 'grenade_c4')::int, 0) +
-       COALESCE((all_weapon_stats -> 'grenade_mk2')::int, 0) + COALESCE((all_weapon_stats -> 'mortar_piat')::int, 0) +
-       COALESCE((all_weapon_stats -> 'rocket_rpg7')::int, 0) + COALESCE((all_weapon_stats -> 'rocket_at4')::int, 0) +
-       COALESCE((all_weapon_stats -> 'grenade_m203_he')::int, 0) +
-       COALESCE((all_weapon_stats -> 'grenade_rifle_enfield')::int, 0) + COALESCE((all_weapon_stats -> 'grenade_gp25_he')::int, 0) +
-       COALESCE((all_weapon_stats -> 'grenade_rifle_k98')::int, 0) + COALESCE((all_weapon_stats -> 'grenade_gp25_lvg')::int, 0) + COALESCE((all_weapon_stats -> 'm590')::int, 0)) >= 1000
-`
-
-	err := getIDAndAwardMedal(explosExpertsQuery, MedalObjectiveExplosivesExpert)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func checkBoltExpert() error {
-	boltExpertsQuery := `
-SELECT users.id
-from users
-         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
-WHERE um.user_id IS NULL
-  AND (COALESCE((all_weapon_stats -> 'mosin')::int, 0) + COALESCE((all_weapon_stats -> 'k98')::int, 0) + COALESCE((all_weapon_stats -> 'springfield')::int, 0) +
-       COALESCE((all_weapon_stats -> 'enfield')::int, 0) + COALESCE((all_weapon_stats -> 'm1garand')::int, 0) + COALESCE((all_weapon_stats -> 'CS5')::int, 0)) >= 1000
-`
-
-	err := getIDAndAwardMedal(boltExpertsQuery, MedalObjectiveBoltExpert)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func checkPistolExpert() error {
-	pistolExpertsQuery := `
-SELECT users.id
-from users
-         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
-WHERE um.user_id IS NULL
-  AND (COALESCE((all_weapon_stats -> 'deagle')::int, 0) + COALESCE((all_weapon_stats -> 'sw500')::int, 0) + COALESCE((all_weapon_stats -> 'makarov')::int, 0) +
-       COALESCE((all_weapon_stats -> 'model10')::int, 0) + COALESCE((all_weapon_stats -> 'welrod')::int, 0) +
-       COALESCE((all_weapon_stats -> 'browninghp')::int, 0) + COALESCE((all_weapon_stats -> 'sw1917')::int, 0) +
-       COALESCE((all_weapon_stats -> 'mr73')::int, 0) + COALESCE((all_weapon_stats -> 'ots33')::int, 0) + COALESCE((all_weapon_stats -> 'glock18')::int, 0)) >=
-      1000
-`
-
-	err := getIDAndAwardMedal(pistolExpertsQuery, MedalObjectivePistolExpert)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func checkKnifeExpert() error {
-	knifeExpertsQuery := `
-SELECT users.id
-from users
-         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
-WHERE um.user_id IS NULL
-  AND COALESCE((all_weapon_stats -> 'gurkha')::int, 0) >= 100
-`
-
-	err := getIDAndAwardMedal(knifeExpertsQuery, MedalObjectiveKnifeExpert)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func getIDAndAwardMedal(query string, medal int) error {
-	rows, err := dbp.DB.Query(query, medal)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil
+			err = checkWeaponExpert(ctx, store, MedalObjectiveRifleExpert, rifles, 5000)
+		case MedalObjectiveCapturer:
+			err = checkObjective(ctx, store, MedalObjectiveCapturer, dbp.ObjectiveCaptures, 100)
+		case MedalObjectiveDemolitionist:
+			err = checkObjective(ctx, store, MedalObjectiveDemolitionist, dbp.ObjectiveCachesDestroyed, 50)
 		}
-		return err
-	}
-	defer rows.Close()
-
-	userStats := make([]uint32, 0)
-	for rows.Next() {
-		var ID uint32
-		err = rows.Scan(&ID)
 		if err != nil {
 			return err
 		}
-
-		userStats = append(userStats, ID)
 	}
 
-	// get any error encountered during iteration
-	err = rows.Err()
+	return nil
+}
+
+// checkWeaponExpert awards the medal to everyone who made at least min kills with the weapons
+func checkWeaponExpert(ctx context.Context, store dbp.Store, medal int, weapons []string, min uint32) error {
+	userIDs, err := store.UsersByWeaponKills(ctx, medal, weapons, min)
 	if err != nil {
 		return err
 	}
 
-	for _, ID := range userStats {
-		insertQuery := `INSERT INTO user_medals (user_id, medal_id) VALUES ($1, $2)`
-		_, err = dbp.DB.Exec(insertQuery, ID, medal)
+	for _, ID := range userIDs {
+		err = store.AwardMedal(ctx, ID, medal)
 		if err != nil {
 			return err
 		}
@@ -244,209 +117,60 @@ func getIDAndAwardMedal(query string, medal int) error {
 	return nil
 }
 
-func checkDieHard() error {
-	wonMatchesQuery := `
-select id, MAX(max_kills)
-from (
-         SELECT users.id, mus.kills as max_kills
-         from users
-                  LEFT JOIN match_user_stats mus on users.id = mus.user_id
-                  LEFT JOIN matches m on mus.match_id = m.id
-         WHERE m.won = true
-           AND mus.deaths = 0
-           AND mus.kills > 20
-         group by users.id, mus.kills) a
-GROUP BY id
-`
-	rows, err := dbp.DB.Query(wonMatchesQuery)
+// checkObjective awards the medal to everyone who did the objective at least min times
+func checkObjective(ctx context.Context, store dbp.Store, medal int, objective dbp.Objective, min uint32) error {
+	userIDs, err := store.UsersByObjective(ctx, medal, objective, min)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil
-		}
 		return err
 	}
-	defer rows.Close()
-
-	type playerStatsStruct struct {
-		ID       uint32 `json:"id"`
-		MaxKills uint32 `json:"max_kills"`
-	}
 
-	userStats := make([]playerStatsStruct, 0)
-	for rows.Next() {
-		var player playerStatsStruct
-		err = rows.Scan(&player.ID, &player.MaxKills)
+	for _, ID := range userIDs {
+		err = store.AwardMedal(ctx, ID, medal)
 		if err != nil {
 			return err
 		}
-
-		userStats = append(userStats, player)
-	}
-
-	// get any error encountered during iteration
-	err = rows.Err()
-	if err != nil {
-		return err
-	}
-
-	for _, userStat := range userStats {
-		// checking if medal is already awarded
-		medalQuery := `SELECT value from user_medals where user_id = $1 AND medal_id = $2`
-
-		var medalKills uint32
-		err := dbp.DB.QueryRow(medalQuery, userStat.ID, MedalObjectiveDieHard).Scan(&medalKills)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				insertQuery := `INSERT INTO user_medals (user_id, medal_id, value) VALUES ($1, $2, $3)`
-				_, err = dbp.DB.Exec(insertQuery, userStat.ID, MedalObjectiveDieHard, userStat.MaxKills)
-				if err != nil {
-					return err
-				}
-			} else {
-				return err
-			}
-		} else {
-			if medalKills < userStat.MaxKills {
-				updateQuery := `UPDATE user_medals SET value = $1 WHERE user_id = $2 AND medal_id = $3`
-
-				_, err = dbp.DB.Exec(updateQuery, userStat.MaxKills, userStat.ID, MedalObjectiveDieHard)
-				if err != nil {
-					return err
-				}
-			}
-		}
 	}
 
 	return nil
 }
 
-func checkIWon() error {
-	wonMatchesQuery := `
-SELECT users.id, COUNT(*)
-from users
-         LEFT JOIN match_user_stats mus on users.id = mus.user_id
-         LEFT JOIN matches m on mus.match_id = m.id
-         LEFT JOIN user_medals um on users.id = um.user_id AND medal_id = $1
-WHERE m.won = true
-  AND um.user_id IS NULL
-group by users.id
-`
-	rows, err := dbp.DB.Query(wonMatchesQuery, MedalObjectiveIWon)
+func checkDieHard(ctx context.Context, store dbp.Store) error {
+	userStats, err := store.DeathlessWins(ctx, 20)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil
-		}
 		return err
 	}
-	defer rows.Close()
 
-	type playerStatsStruct struct {
-		ID    uint32 `json:"id"`
-		Count uint32 `json:"count"`
-	}
-
-	userStats := make([]playerStatsStruct, 0)
-	for rows.Next() {
-		var player playerStatsStruct
-		err = rows.Scan(&player.ID, &player.Count)
-		if err != nil {
+	for _, userStat := range userStats {
+		// checking if medal is already awarded
+		medalKills, err := store.MedalValue(ctx, userStat.ID, MedalObjectiveDieHard)
+		if err != nil && !errors.Is(err, dbp.ErrNotFound) {
 			return err
 		}
 
-		if player.Count >= 5 {
-			userStats = append(userStats, player)
-		}
-	}
-
-	// get any error encountered during iteration
-	err = rows.Err()
-	if err != nil {
-		return err
-	}
-
-	for _, userStat := range userStats {
-		insertQuery := `INSERT INTO user_medals (user_id, medal_id) VALUES ($1, $2)`
-		_, err = dbp.DB.Exec(insertQuery, userStat.ID, MedalObjectiveIWon)
-		if err != nil {
-			return err
+		if errors.Is(err, dbp.ErrNotFound) || medalKills < userStat.Value {
+			err = store.SetMedalValue(ctx, userStat.ID, MedalObjectiveDieHard, userStat.Value)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
-func checkMostKills() error {
-	userQuery := `SELECT id, kills from users where ORDER BY kills DESC LIMIT 1`
-	medalQuery := `SELECT user_id, value from user_medals where medal_id = $1 WHERE current = TRUE`
-	insertQuery := `INSERT INTO user_medals (user_id, medal_id, value, current) VALUES ($1, $2, $3, $4)`
-
-	var userID, kills int
-	err := dbp.DB.QueryRow(userQuery).Scan(&userID, &kills)
+// checkIWon Get 5 wins.
+func checkIWon(ctx context.Context, store dbp.Store) error {
+	userIDs, err := store.UsersByWins(ctx, MedalObjectiveIWon, 5)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil
-		}
 		return err
 	}
 
-	var medalUserID, value int
-	err = dbp.DB.QueryRow(medalQuery, MedalObjectiveMostKillsCurrent).Scan(&medalUserID, &value)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			_, err = dbp.DB.Exec(insertQuery, userID, MedalObjectiveMostKillsCurrent, kills, true)
-			if err != nil {
-				return err
-			}
-			return nil
-		} else {
+	for _, ID := range userIDs {
+		err = store.AwardMedal(ctx, ID, MedalObjectiveIWon)
+		if err != nil {
 			return err
 		}
 	}
 
-	if medalUserID == userID {
-		if value < kills {
-			updateQuery := `UPDATE user_medals SET value = $1 WHERE user_id = $2 AND medal_id = $3`
-
-			_, err = dbp.DB.Exec(updateQuery, kills, userID, MedalObjectiveMostKillsCurrent)
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		if value < kills {
-			//check if user has medal
-			oldMedalQuery := `SELECT value from user_medals where user_id = $1 AND medal_id = $2`
-
-			var oldValue int
-			err = dbp.DB.QueryRow(oldMedalQuery, userID, MedalObjectiveMostKillsCurrent).Scan(&oldValue)
-			if err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					//adding new medal
-					_, err = dbp.DB.Exec(insertQuery, userID, MedalObjectiveMostKillsCurrent, kills, true)
-					if err != nil {
-						return err
-					}
-				} else {
-					return err
-				}
-			} else {
-				//updating old medal
-				updateQuery := `UPDATE user_medals SET value = $1, current = TRUE WHERE user_id = $2 AND medal_id = $3 AND current = FALSE`
-
-				_, err = dbp.DB.Exec(updateQuery, kills, userID, MedalObjectiveMostKillsCurrent)
-				if err != nil {
-					return err
-				}
-			}
-
-			updateSecondPlaceQuery := `UPDATE user_medals SET current = FALSE WHERE user_id = $1 AND medal_id = $2 AND current = TRUE`
-
-			_, err = dbp.DB.Exec(updateSecondPlaceQuery, medalUserID, MedalObjectiveMostKillsCurrent)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
 	return nil
 }
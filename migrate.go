@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/j0y/insurgency-parser/dbp"
+	"log"
+	"os"
+	"time"
+)
+
+// migrateCommand applies, reverts or lists the schema migrations embedded in the binary
+func migrateCommand(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	steps := flags.Int("steps", 1, "how many migrations down reverts")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: migrate [flags] up|down|status\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	store, err := openDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	migrator, ok := store.(dbp.Migrator)
+	if !ok {
+		log.Fatalf("%s doesn't use migrations", os.Getenv("DB_DRIVER"))
+	}
+
+	switch flags.Arg(0) {
+	case "up":
+		applied, err := migrator.MigrateUp(ctx)
+		for _, migration := range applied {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		reverted, err := migrator.MigrateDown(ctx, *steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		migrations, err := migrator.Migrations(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, migration := range migrations {
+			status := "pending"
+			if migration.AppliedAt != 0 {
+				status = "applied " + time.Unix(migration.AppliedAt, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30s %s\n", migration.Version, migration.Name, status)
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
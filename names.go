@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// namesCommand prints the names a player used, the most recent one first
+func namesCommand(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("names", flag.ExitOnError)
+	printJSON := flags.Bool("json", false, "print the names as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: names [flags] <STEAM_X:Y:Z|[U:1:Z]|SteamID64>\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	userID, err := userIDFromSteamID(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	names, err := store.UserNames(ctx, userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *printJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(names)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	for _, name := range names {
+		if name.LastSeen == 0 {
+			fmt.Printf("%-19s %-19s %s\n", "unknown", "unknown", name.Name)
+			continue
+		}
+		fmt.Printf("%s %s %s\n", formatTime(name.FirstSeen), formatTime(name.LastSeen), name.Name)
+	}
+}
+
+func formatTime(t uint64) string {
+	return time.Unix(int64(t), 0).UTC().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/j0y/insurgency-parser/medals"
+	"github.com/j0y/insurgency-parser/parser"
+	"io"
+	"log"
+	"os"
+)
+
+// parseCommand parses one log file, or stdin when the file is "-",
+// and writes the match to the database or prints it as JSON
+func parseCommand(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("parse", flag.ExitOnError)
+	printJSON := flags.Bool("json", false, "print the match as JSON instead of writing it to the database")
+	ip := flags.String("ip", "", "server ip, taken from the file name when not set, required for stdin")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: parse [flags] <file|->\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	pathFilename := flags.Arg(0)
+
+	var input io.Reader
+	if pathFilename == "-" {
+		if len(*ip) == 0 {
+			log.Fatal("-ip is required when reading from stdin")
+		}
+		input = os.Stdin
+	} else {
+		if len(*ip) == 0 {
+			var err error
+			*ip, err = parser.IPFromFilename(pathFilename)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		file, err := os.Open(pathFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	results, err := parser.ParseReader(input, parser.Options{Ip: *ip, Errors: os.Stderr})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *printJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	matches := make([]*parser.MatchResult, 0, len(results))
+	for _, result := range results {
+		// lines written before the first map was loaded are skipped
+		if len(result.Match.Map) > 0 {
+			matches = append(matches, result)
+		}
+	}
+	if len(matches) == 0 {
+		log.Fatalf("map is empty in %s", pathFilename)
+	}
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	for _, result := range matches {
+		var matchID uint32
+		err = retry(ctx, pathFilename, func() error {
+			var err error
+			matchID, err = saveMatch(ctx, store, result)
+			return err
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("Finished processing match ", matchID)
+	}
+
+	err = retry(ctx, "medals", func() error {
+		return medals.UpdateMedals(ctx, store)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
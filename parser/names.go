@@ -0,0 +1,61 @@
+package parser
+
+import insurgencylog "github.com/j0y/insurgency-log"
+
+// PlayerName is a name a player used in a match
+type PlayerName struct {
+	SteamID   string `json:"steam_id"`
+	Name      string `json:"name"`
+	FirstSeen uint64 `json:"first_seen"`
+	LastSeen  uint64 `json:"last_seen"`
+}
+
+// messagePlayers returns the players a message was logged for
+func messagePlayers(message insurgencylog.Message) []insurgencylog.Player {
+	switch m := message.(type) {
+	case insurgencylog.PlayerKill:
+		return []insurgencylog.Player{m.Attacker, m.Victim}
+	case insurgencylog.PlayerKilledSuicide:
+		return []insurgencylog.Player{m.Player}
+	case insurgencylog.PlayerConnected:
+		return []insurgencylog.Player{m.Player}
+	case insurgencylog.PlayerEntered:
+		return []insurgencylog.Player{m.Player}
+	case insurgencylog.PlayerDisconnected:
+		return []insurgencylog.Player{m.Player}
+	case insurgencylog.PlayerSay:
+		return []insurgencylog.Player{m.Player}
+	case PlayerTriggered:
+		return []insurgencylog.Player{m.Player}
+	case PlayerNameChanged:
+		return []insurgencylog.Player{m.Player}
+	}
+
+	return nil
+}
+
+// seeName records that the player used the name at seenAt
+func (m *matchState) seeName(steamID string, name string, seenAt uint64) {
+	if !IsSteamID(steamID) || len(name) == 0 {
+		return
+	}
+
+	for i := range m.result.Names {
+		playerName := &m.result.Names[i]
+		if playerName.SteamID != steamID || playerName.Name != name {
+			continue
+		}
+		if seenAt > playerName.LastSeen {
+			playerName.LastSeen = seenAt
+			m.namesChanged[i] = struct{}{}
+		}
+		if seenAt < playerName.FirstSeen {
+			playerName.FirstSeen = seenAt
+			m.namesChanged[i] = struct{}{}
+		}
+		return
+	}
+
+	m.result.Names = append(m.result.Names, PlayerName{SteamID: steamID, Name: name, FirstSeen: seenAt, LastSeen: seenAt})
+	m.namesChanged[len(m.result.Names)-1] = struct{}{}
+}
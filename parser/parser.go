@@ -0,0 +1,653 @@
+// Package parser accumulates match and player statistics from insurgency
+// server logs. It does not touch the database, so the same logic can be
+// reused by the ingestion daemon, command line tools and tests.
+package parser
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	insurgencylog "github.com/j0y/insurgency-log"
+	"github.com/j0y/insurgency-parser/steamid"
+	"io"
+	"path/filepath"
+	"regexp"
+)
+
+// Version is stored with every parsed file, increase it when the same log starts producing different stats
+const Version = 11
+
+// ErrIPNotFound is returned when a log file name doesn't start with the server ip
+var ErrIPNotFound = errors.New("ip not found")
+
+type MatchInfo struct {
+	Map       string `json:"map"`
+	Rounds    uint8  `json:"rounds"`
+	StartedAt uint64 `json:"started_at"`
+	Duration  uint32 `json:"duration"`
+	Won       bool   `json:"won"`
+	Ip        string `json:"ip"`
+	// Mode is the game mode from mp_gamemode, empty when it wasn't logged
+	Mode string `json:"mode"`
+}
+
+type WeaponStats map[string]uint32
+
+type PlayerStats struct {
+	Name string `json:"name"`
+	// Team is the last team the player was seen in, TeamSecurity or TeamInsurgent
+	Team string `json:"team"`
+	// Kills and Deaths count kills of bots and deaths by bots
+	Kills  uint32 `json:"kills"`
+	Deaths uint32 `json:"deaths"`
+	// PvPKills and PvPDeaths count kills of and deaths by players of the other team in versus modes
+	PvPKills  uint32 `json:"pvp_kills"`
+	PvPDeaths uint32 `json:"pvp_deaths"`
+	// Fratricide counts teammates the player killed, killing yourself is a suicide
+	Fratricide uint32 `json:"fratricide"`
+	// Suicides counts kills of yourself, like with your own grenade
+	Suicides uint32 `json:"suicides"`
+	// EnvironmentDeaths counts deaths by falling or by the map
+	EnvironmentDeaths uint32      `json:"environment_deaths"`
+	WeaponStats       WeaponStats `json:"weapon_stats"`
+	// DeathWeaponStats counts the weapons bots killed the player with
+	DeathWeaponStats WeaponStats `json:"death_weapon_stats"`
+	// Playtime is the length of the sessions of the player which are over in seconds
+	Playtime uint32 `json:"playtime"`
+	// Captures, CachesDestroyed and Defends count objectives the player captured, destroyed or defended
+	Captures        uint32 `json:"captures"`
+	CachesDestroyed uint32 `json:"caches_destroyed"`
+	Defends         uint32 `json:"defends"`
+}
+
+// Value Returns the JSON-encoded representation
+func (a WeaponStats) Value() (driver.Value, error) {
+	if len(a) == 0 {
+		return "{}", nil
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	// text, so it's stored as JSON and not as a blob in SQLite
+	return string(b), nil
+}
+
+// RoundInfo is a round of a match, rounds are numbered from 1 in the order they were played.
+// A round starts with Round_Start, or when the previous one ended if it wasn't logged, and ends with Round_Win.
+type RoundInfo struct {
+	Number    uint8  `json:"number"`
+	StartedAt uint64 `json:"started_at"`
+	// EndedAt is 0 while the round is played
+	EndedAt uint64 `json:"ended_at"`
+	// Winner is TeamSecurity or TeamInsurgent, empty while the round is played or when the map changed before the end
+	Winner string `json:"winner"`
+}
+
+type RoundPlayerStats struct {
+	Kills     uint32 `json:"kills"`
+	Deaths    uint32 `json:"deaths"`
+	PvPKills  uint32 `json:"pvp_kills"`
+	PvPDeaths uint32 `json:"pvp_deaths"`
+}
+
+// RoundResult holds the stats of a round, players are keyed by SteamID
+type RoundResult struct {
+	Round   RoundInfo                   `json:"round"`
+	Players map[string]RoundPlayerStats `json:"players"`
+}
+
+// KillPlayer is the attacker or victim of a kill
+type KillPlayer struct {
+	// SteamID is insurgencylog.PlayerBot for bots
+	SteamID string `json:"steam_id"`
+	Name    string `json:"name"`
+	// Team is TeamSecurity or TeamInsurgent
+	Team string `json:"team"`
+}
+
+func (k KillPlayer) IsBot() bool {
+	return k.SteamID == insurgencylog.PlayerBot
+}
+
+// KillEvent is a single kill, Seq numbers the kills of a match from 1 in the order they happened
+type KillEvent struct {
+	Seq      uint32     `json:"seq"`
+	Time     uint64     `json:"time"`
+	Attacker KillPlayer `json:"attacker"`
+	Victim   KillPlayer `json:"victim"`
+	Weapon   string     `json:"weapon"`
+}
+
+// ChatMessage is a say or say_team line, Seq numbers the messages of a match from 1 in the order they were sent
+type ChatMessage struct {
+	Seq  uint32 `json:"seq"`
+	Time uint64 `json:"time"`
+	// SteamID is "Console" for the server console
+	SteamID string `json:"steam_id"`
+	Name    string `json:"name"`
+	Team    string `json:"team"`
+	// TeamOnly is set for say_team
+	TeamOnly bool   `json:"team_only"`
+	Text     string `json:"text"`
+}
+
+// MatchResult holds everything collected from a single log, players are keyed by SteamID
+type MatchResult struct {
+	Match   MatchInfo              `json:"match"`
+	Players map[string]PlayerStats `json:"players"`
+	Rounds  []RoundResult          `json:"rounds"`
+	// Kills are the kills not returned by TakeChanges yet, all of them when it's not used
+	Kills []KillEvent `json:"kills"`
+	// Chat are the messages not returned by TakeChanges yet, like Kills
+	Chat     []ChatMessage `json:"chat"`
+	Sessions []Session     `json:"sessions"`
+	// Names are the names every player used, with the time they were first and last seen
+	Names []PlayerName `json:"names"`
+}
+
+// Options changes how a log is parsed
+type Options struct {
+	// Ip of the server which wrote the log, see IPFromFilename
+	Ip string
+	// Errors receives lines which couldn't be parsed, nil discards them
+	Errors io.Writer
+}
+
+// Parser accumulates stats line by line, use it when the log is not available at once.
+// Every map played in the log is a separate match.
+type Parser struct {
+	opts    Options
+	matches []*matchState
+}
+
+// matchState is a match being collected and what changed in it since the last TakeChanges call
+type matchState struct {
+	result         MatchResult
+	matchChanged   bool
+	playersChanged map[string]struct{}
+	// roundsChanged holds indexes of result.Rounds
+	roundsChanged map[int]struct{}
+	// sessionsChanged holds indexes of result.Sessions
+	sessionsChanged map[int]struct{}
+	// namesChanged holds indexes of result.Names
+	namesChanged map[int]struct{}
+	// killSeq is the Seq of the last kill
+	killSeq uint32
+	// chatSeq is the Seq of the last chat message
+	chatSeq uint32
+}
+
+// savedMatch is a match in the parser state
+type savedMatch struct {
+	MatchResult
+	KillSeq uint32 `json:"kill_seq"`
+	ChatSeq uint32 `json:"chat_seq"`
+}
+
+func New(opts Options) *Parser {
+	p := &Parser{opts: opts}
+	p.startMatch()
+
+	return p
+}
+
+func (p *Parser) startMatch() {
+	var mode string
+	if len(p.matches) > 0 {
+		// the cvar is kept when the map changes
+		mode = p.Result().Match.Mode
+	}
+
+	p.matches = append(p.matches, &matchState{
+		result: MatchResult{
+			Match:   MatchInfo{Ip: p.opts.Ip, Mode: mode},
+			Players: make(map[string]PlayerStats),
+		},
+		playersChanged:  make(map[string]struct{}),
+		roundsChanged:   make(map[int]struct{}),
+		sessionsChanged: make(map[int]struct{}),
+		namesChanged:    make(map[int]struct{}),
+	})
+}
+
+// openRound returns the round being played, a new one is started if the previous round is over
+func (m *matchState) openRound() *RoundResult {
+	rounds := m.result.Rounds
+	if len(rounds) > 0 && rounds[len(rounds)-1].Round.EndedAt == 0 {
+		return &rounds[len(rounds)-1]
+	}
+
+	startedAt := m.result.Match.StartedAt
+	if len(rounds) > 0 {
+		startedAt = rounds[len(rounds)-1].Round.EndedAt
+	}
+	m.result.Rounds = append(rounds, RoundResult{
+		Round:   RoundInfo{Number: uint8(len(rounds) + 1), StartedAt: startedAt},
+		Players: make(map[string]RoundPlayerStats),
+	})
+	m.roundsChanged[len(m.result.Rounds)-1] = struct{}{}
+
+	return &m.result.Rounds[len(m.result.Rounds)-1]
+}
+
+// startRound moves the start of the round being played to startedAt, unless someone was killed in it already
+func (m *matchState) startRound(startedAt uint64) {
+	round := m.openRound()
+	if len(round.Players) == 0 {
+		round.Round.StartedAt = startedAt
+		m.roundsChanged[len(m.result.Rounds)-1] = struct{}{}
+	}
+}
+
+// changeRoundPlayer applies change to the stats of the player in the round being played
+func (m *matchState) changeRoundPlayer(steamID string, change func(stats *RoundPlayerStats)) {
+	round := m.openRound()
+	stats := round.Players[steamID]
+	change(&stats)
+	round.Players[steamID] = stats
+	m.roundsChanged[len(m.result.Rounds)-1] = struct{}{}
+}
+
+// endRound ends the round being played, if there is one
+func (m *matchState) endRound(endedAt uint64, winner string) {
+	rounds := m.result.Rounds
+	if winner == "" && (len(rounds) == 0 || rounds[len(rounds)-1].Round.EndedAt != 0) {
+		return
+	}
+
+	round := m.openRound()
+	round.Round.EndedAt = endedAt
+	round.Round.Winner = winner
+	m.roundsChanged[len(m.result.Rounds)-1] = struct{}{}
+}
+
+// Restore creates a parser which continues where the one that returned the state stopped
+func Restore(opts Options, state []byte) (*Parser, error) {
+	var saved []savedMatch
+	err := json.Unmarshal(state, &saved)
+	if err != nil {
+		return nil, err
+	}
+	if len(saved) == 0 {
+		return nil, errors.New("empty parser state")
+	}
+
+	p := &Parser{opts: opts}
+	for _, match := range saved {
+		result := match.MatchResult
+		if result.Players == nil {
+			result.Players = make(map[string]PlayerStats)
+		}
+		for i := range result.Rounds {
+			if result.Rounds[i].Players == nil {
+				result.Rounds[i].Players = make(map[string]RoundPlayerStats)
+			}
+		}
+		p.matches = append(p.matches, &matchState{
+			result:          result,
+			playersChanged:  make(map[string]struct{}),
+			roundsChanged:   make(map[int]struct{}),
+			sessionsChanged: make(map[int]struct{}),
+			namesChanged:    make(map[int]struct{}),
+			killSeq:         match.KillSeq,
+			chatSeq:         match.ChatSeq,
+		})
+	}
+
+	return p, nil
+}
+
+// State returns everything collected so far for Restore, changes not taken yet are not tracked in it
+func (p *Parser) State() ([]byte, error) {
+	saved := make([]savedMatch, 0, len(p.matches))
+	for _, match := range p.matches {
+		saved = append(saved, savedMatch{MatchResult: match.result, KillSeq: match.killSeq, ChatSeq: match.chatSeq})
+	}
+
+	return json.Marshal(saved)
+}
+
+// ParseReader reads the whole log and returns every match played in it
+func ParseReader(r io.Reader, opts Options) ([]*MatchResult, error) {
+	p := New(opts)
+
+	br := bufio.NewReader(r)
+	for {
+		l, err := br.ReadString('\n')
+		if len(l) > 0 {
+			p.ParseLine(l)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+	}
+
+	return p.Matches(), nil
+}
+
+// IPFromFilename extracts the server ip from a log file name like 1.2.3.4_27015_123.log
+func IPFromFilename(pathFilename string) (string, error) {
+	ip := ipRe.FindString(filepath.Base(pathFilename))
+	if len(ip) == 0 {
+		return "", ErrIPNotFound
+	}
+
+	return ip, nil
+}
+
+var ipRe = regexp.MustCompile(`^[0-9,.]*`)
+
+// Result returns the stats of the match being played
+func (p *Parser) Result() *MatchResult {
+	return &p.matches[len(p.matches)-1].result
+}
+
+// Matches returns every match seen so far, a match without map was played before the first map load
+func (p *Parser) Matches() []*MatchResult {
+	results := make([]*MatchResult, 0, len(p.matches))
+	for _, match := range p.matches {
+		results = append(results, &match.result)
+	}
+
+	return results
+}
+
+// Changed reports if anything was collected since the last TakeChanges call
+func (p *Parser) Changed() bool {
+	for _, match := range p.matches {
+		if len(match.result.Match.Map) > 0 && match.changed() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *matchState) changed() bool {
+	return m.matchChanged || len(m.playersChanged) > 0 || len(m.roundsChanged) > 0 || len(m.sessionsChanged) > 0 ||
+		len(m.namesChanged) > 0 ||
+		len(m.result.Kills) > 0 || len(m.result.Chat) > 0
+}
+
+// TakeChanges returns the matches which changed since the previous call, with only the players, rounds, sessions
+// and names which changed and the new kills and chat messages, which are not kept by the parser after that.
+// Matches without map are kept until the map is known.
+func (p *Parser) TakeChanges() []*MatchResult {
+	changes := make([]*MatchResult, 0)
+	for _, match := range p.matches {
+		if len(match.result.Match.Map) == 0 || !match.changed() {
+			continue
+		}
+
+		changed := &MatchResult{
+			Match:   match.result.Match,
+			Players: make(map[string]PlayerStats, len(match.playersChanged)),
+		}
+		accounts := make(map[int64]struct{}, len(match.playersChanged))
+		for steamID := range match.playersChanged {
+			changed.Players[steamID] = match.result.Players[steamID]
+			if id, err := steamid.Parse(steamID); err == nil {
+				accounts[id] = struct{}{}
+			}
+		}
+		// the other SteamID forms of a changed player come with it, they are written as one user
+		for steamID, stats := range match.result.Players {
+			if id, err := steamid.Parse(steamID); err == nil {
+				if _, ok := accounts[id]; ok {
+					changed.Players[steamID] = stats
+				}
+			}
+		}
+		for i, round := range match.result.Rounds {
+			if _, ok := match.roundsChanged[i]; !ok {
+				continue
+			}
+			players := make(map[string]RoundPlayerStats, len(round.Players))
+			for steamID, stats := range round.Players {
+				players[steamID] = stats
+			}
+			changed.Rounds = append(changed.Rounds, RoundResult{Round: round.Round, Players: players})
+		}
+		for i, session := range match.result.Sessions {
+			if _, ok := match.sessionsChanged[i]; ok {
+				changed.Sessions = append(changed.Sessions, session)
+			}
+		}
+		for i, name := range match.result.Names {
+			if _, ok := match.namesChanged[i]; ok {
+				changed.Names = append(changed.Names, name)
+			}
+		}
+		changed.Kills = match.result.Kills
+		changed.Chat = match.result.Chat
+		changes = append(changes, changed)
+
+		match.matchChanged = false
+		match.playersChanged = make(map[string]struct{})
+		match.roundsChanged = make(map[int]struct{})
+		match.sessionsChanged = make(map[int]struct{})
+		match.namesChanged = make(map[int]struct{})
+		match.result.Kills = nil
+		match.result.Chat = nil
+	}
+
+	return changes
+}
+
+// ParseLine adds a single log line to the collected stats
+func (p *Parser) ParseLine(line string) {
+	message, err := parseMessage(trimNewline(line))
+	if err != nil {
+		if p.opts.Errors != nil {
+			// report parse errors, they are not fatal
+			fmt.Fprintf(p.opts.Errors, "ERROR: %s: %s\n", err, trimNewline(line))
+		}
+		return
+	}
+
+	if _, ok := message.(insurgencylog.LoadingMap); ok && len(p.Result().Match.Map) > 0 {
+		// next map in the same log
+		p.matches[len(p.matches)-1].endSessions(getAdjustedTime(message.GetTime().Unix()))
+		p.startMatch()
+	}
+
+	current := p.matches[len(p.matches)-1]
+	matchInfo := &current.result.Match
+	playerStats := current.result.Players
+
+	before := *matchInfo
+	defer func() {
+		if *matchInfo != before {
+			current.matchChanged = true
+		}
+	}()
+
+	for _, player := range messagePlayers(message) {
+		current.seeName(player.SteamID, player.Name, getAdjustedTime(message.GetTime().Unix()))
+	}
+
+	switch m := message.(type) {
+	case insurgencylog.LoadingMap:
+		matchInfo.Map = m.Map
+		matchInfo.StartedAt = getAdjustedTime(m.Time.Unix())
+	case insurgencylog.PlayerKill:
+		current.killSeq++
+		current.result.Kills = append(current.result.Kills, KillEvent{
+			Seq:      current.killSeq,
+			Time:     getAdjustedTime(m.Time.Unix()),
+			Attacker: KillPlayer{SteamID: m.Attacker.SteamID, Name: m.Attacker.Name, Team: m.Attacker.Side},
+			Victim:   KillPlayer{SteamID: m.Victim.SteamID, Name: m.Victim.Name, Team: m.Victim.Side},
+			Weapon:   m.Weapon,
+		})
+
+		if m.Attacker.SteamID == insurgencylog.PlayerBot && m.Victim.SteamID != insurgencylog.PlayerBot {
+			stats := playerStats[m.Victim.SteamID]
+			if len(stats.Name) == 0 {
+				stats.Name = m.Victim.Name
+			}
+			stats.Team = m.Victim.Side
+			stats.Deaths++
+
+			if stats.DeathWeaponStats == nil {
+				stats.DeathWeaponStats = make(WeaponStats)
+			}
+			stats.DeathWeaponStats[m.Weapon]++
+
+			playerStats[m.Victim.SteamID] = stats
+			current.playersChanged[m.Victim.SteamID] = struct{}{}
+			current.changeRoundPlayer(m.Victim.SteamID, func(stats *RoundPlayerStats) { stats.Deaths++ })
+		}
+		if m.Victim.SteamID == insurgencylog.PlayerBot && m.Attacker.SteamID != insurgencylog.PlayerBot {
+			stats := playerStats[m.Attacker.SteamID]
+			if len(stats.Name) == 0 {
+				stats.Name = m.Attacker.Name
+			}
+			stats.Team = m.Attacker.Side
+			stats.Kills++
+
+			if stats.WeaponStats == nil {
+				stats.WeaponStats = make(WeaponStats)
+			}
+			stats.WeaponStats[m.Weapon]++
+
+			playerStats[m.Attacker.SteamID] = stats
+			current.playersChanged[m.Attacker.SteamID] = struct{}{}
+			current.changeRoundPlayer(m.Attacker.SteamID, func(stats *RoundPlayerStats) { stats.Kills++ })
+		}
+		if m.Attacker.SteamID != insurgencylog.PlayerBot && m.Victim.SteamID != insurgencylog.PlayerBot {
+			stats := playerStats[m.Attacker.SteamID]
+			if len(stats.Name) == 0 {
+				stats.Name = m.Attacker.Name
+			}
+			stats.Team = m.Attacker.Side
+			enemy := false
+			switch {
+			case m.Attacker.SteamID == m.Victim.SteamID && m.Attacker.ID == m.Victim.ID:
+				// players without a steam account share the SteamID, not the user id of their connection
+				stats.Suicides++
+			case isCoop(matchInfo.Mode) || m.Attacker.Side == m.Victim.Side:
+				// in coop all players are in the same team
+				stats.Fratricide++
+			default:
+				enemy = true
+				stats.PvPKills++
+			}
+			playerStats[m.Attacker.SteamID] = stats
+			current.playersChanged[m.Attacker.SteamID] = struct{}{}
+
+			if enemy {
+				stats := playerStats[m.Victim.SteamID]
+				if len(stats.Name) == 0 {
+					stats.Name = m.Victim.Name
+				}
+				stats.Team = m.Victim.Side
+				stats.PvPDeaths++
+				playerStats[m.Victim.SteamID] = stats
+				current.playersChanged[m.Victim.SteamID] = struct{}{}
+
+				current.changeRoundPlayer(m.Attacker.SteamID, func(stats *RoundPlayerStats) { stats.PvPKills++ })
+				current.changeRoundPlayer(m.Victim.SteamID, func(stats *RoundPlayerStats) { stats.PvPDeaths++ })
+			}
+		}
+	case insurgencylog.PlayerKilledSuicide:
+		if m.Player.SteamID != insurgencylog.PlayerBot {
+			stats := playerStats[m.Player.SteamID]
+			if len(stats.Name) == 0 {
+				stats.Name = m.Player.Name
+			}
+			if isEnvironment(m.With) {
+				stats.EnvironmentDeaths++
+			} else {
+				stats.Suicides++
+			}
+			playerStats[m.Player.SteamID] = stats
+			current.playersChanged[m.Player.SteamID] = struct{}{}
+		}
+	case insurgencylog.PlayerConnected:
+		current.joinSession(m.Player.SteamID, m.Player.Name, getAdjustedTime(m.Time.Unix()))
+	case insurgencylog.PlayerEntered:
+		current.joinSession(m.Player.SteamID, m.Player.Name, getAdjustedTime(m.Time.Unix()))
+	case insurgencylog.PlayerDisconnected:
+		current.leaveSession(m.Player.SteamID, getAdjustedTime(m.Time.Unix()), m.Reason)
+	case insurgencylog.PlayerSay:
+		current.chatSeq++
+		current.result.Chat = append(current.result.Chat, ChatMessage{
+			Seq:      current.chatSeq,
+			Time:     getAdjustedTime(m.Time.Unix()),
+			SteamID:  m.Player.SteamID,
+			Name:     m.Player.Name,
+			Team:     m.Player.Side,
+			TeamOnly: m.Team,
+			Text:     m.Text,
+		})
+	case PlayerTriggered:
+		what, ok := objectiveEvents[m.Event]
+		if ok && m.Player.SteamID != insurgencylog.PlayerBot {
+			stats := playerStats[m.Player.SteamID]
+			if len(stats.Name) == 0 {
+				stats.Name = m.Player.Name
+			}
+			stats.Team = m.Player.Side
+			switch what {
+			case objectiveCapture:
+				stats.Captures++
+			case objectiveCacheDestroyed:
+				stats.CachesDestroyed++
+			case objectiveDefend:
+				stats.Defends++
+			}
+			playerStats[m.Player.SteamID] = stats
+			current.playersChanged[m.Player.SteamID] = struct{}{}
+		}
+	case PlayerNameChanged:
+		current.seeName(m.Player.SteamID, m.NewName, getAdjustedTime(m.Time.Unix()))
+	case GameMode:
+		matchInfo.Mode = m.Mode
+	case insurgencylog.WorldRoundStart:
+		current.startRound(getAdjustedTime(m.Time.Unix()))
+	case insurgencylog.RoundWin:
+		current.endRound(getAdjustedTime(m.Time.Unix()), m.Team)
+		if m.Team == insurgencylog.TeamSecurity {
+			matchInfo.Rounds++
+		} else if m.Team == insurgencylog.TeamInsurgent {
+			matchInfo.Won = true
+			matchInfo.Duration = uint32(getAdjustedTime(m.Time.Unix()) - matchInfo.StartedAt)
+		}
+	case insurgencylog.NextLevel:
+		if matchInfo.Duration == 0 && m.Level != "" {
+			//changing map without winning
+			matchInfo.Duration = uint32(getAdjustedTime(m.Time.Unix()) - matchInfo.StartedAt)
+			current.endRound(getAdjustedTime(m.Time.Unix()), "")
+		}
+	case insurgencylog.ServerMessage:
+		if m.Text == "quit" {
+			if matchInfo.Duration == 0 {
+				//changing map without winning
+				matchInfo.Duration = uint32(getAdjustedTime(m.Time.Unix()) - matchInfo.StartedAt)
+				current.endRound(getAdjustedTime(m.Time.Unix()), "")
+			}
+			current.endSessions(getAdjustedTime(m.Time.Unix()))
+			//match over
+		}
+	}
+}
+
+func trimNewline(line string) string {
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+const minute = 60
+const hour = 60 * minute
+
+func getAdjustedTime(unixtime int64) uint64 {
+	return uint64(unixtime - 10*hour)
+}
@@ -0,0 +1,536 @@
+package parser
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logLines turns messages into a log, the first one is logged at 20:00 and every next one a minute later
+func logLines(messages ...string) string {
+	var log strings.Builder
+	for i, message := range messages {
+		fmt.Fprintf(&log, "L 04/19/2022 - 20:%02d:00: %s\n", i, message)
+	}
+
+	return log.String()
+}
+
+// startTime is the adjusted time of the first message of logLines
+var startTime = getAdjustedTime(time.Date(2022, 4, 19, 20, 0, 0, 0, time.UTC).Unix())
+
+const (
+	loadMarket = `Loading map "market"`
+	aliceKills = `"Alice<2><STEAM_1:0:12345><#Team_Security>" killed "Bot<5><BOT><#Team_Insurgent>" with "akm<12>" at (1.0, 2.0, 3.0)`
+	botKills   = `"Bot<5><BOT><#Team_Insurgent>" killed "Alice<2><STEAM_1:0:12345><#Team_Security>" with "rpk<13>" at (1.0, 2.0, 3.0)`
+	aliceID    = "STEAM_1:0:12345"
+)
+
+func TestParseReader(t *testing.T) {
+	tests := []struct {
+		name        string
+		messages    []string
+		wantMatch   MatchInfo
+		wantPlayers map[string]PlayerStats
+	}{
+		{
+			name:      "kills and deaths by bots",
+			messages:  []string{loadMarket, aliceKills, aliceKills, botKills},
+			wantMatch: MatchInfo{Map: "market", StartedAt: startTime, Ip: "1.2.3.4"},
+			wantPlayers: map[string]PlayerStats{
+				aliceID: {Name: "Alice", Team: "Security", Kills: 2, Deaths: 1, WeaponStats: WeaponStats{"akm": 2},
+					DeathWeaponStats: WeaponStats{"rpk": 1}},
+			},
+		},
+		{
+			name: "won",
+			messages: []string{loadMarket, `Team "#Team_Security" triggered "Round_Win"`,
+				`Team "#Team_Insurgent" triggered "Round_Win"`},
+			wantMatch:   MatchInfo{Map: "market", Rounds: 1, StartedAt: startTime, Duration: 2 * minute, Won: true, Ip: "1.2.3.4"},
+			wantPlayers: map[string]PlayerStats{},
+		},
+		{
+			name:        "map changed without winning",
+			messages:    []string{loadMarket, `server_cvar: "nextlevel" "sinjar"`},
+			wantMatch:   MatchInfo{Map: "market", StartedAt: startTime, Duration: minute, Ip: "1.2.3.4"},
+			wantPlayers: map[string]PlayerStats{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := ParseReader(strings.NewReader(logLines(test.messages...)), Options{Ip: "1.2.3.4"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) != 1 {
+				t.Fatalf("got %d matches, want 1", len(matches))
+			}
+
+			result := matches[0]
+			if result.Match != test.wantMatch {
+				t.Errorf("got match %+v, want %+v", result.Match, test.wantMatch)
+			}
+			if !reflect.DeepEqual(result.Players, test.wantPlayers) {
+				t.Errorf("got players %+v, want %+v", result.Players, test.wantPlayers)
+			}
+		})
+	}
+}
+
+func TestParseSplitsMatchesOnMapLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		// wantMaps are the maps of the matches and wantKills the kills of Alice in them
+		wantMaps  []string
+		wantKills []uint32
+	}{
+		{
+			name:      "one map",
+			messages:  []string{loadMarket, aliceKills, aliceKills},
+			wantMaps:  []string{"market"},
+			wantKills: []uint32{2},
+		},
+		{
+			name:      "two maps",
+			messages:  []string{loadMarket, aliceKills, `Loading map "sinjar"`, aliceKills, aliceKills},
+			wantMaps:  []string{"market", "sinjar"},
+			wantKills: []uint32{1, 2},
+		},
+		{
+			name:      "same map loaded again",
+			messages:  []string{loadMarket, aliceKills, loadMarket, aliceKills},
+			wantMaps:  []string{"market", "market"},
+			wantKills: []uint32{1, 1},
+		},
+		{
+			name:      "kills before the first map",
+			messages:  []string{aliceKills, loadMarket, aliceKills},
+			wantMaps:  []string{"market"},
+			wantKills: []uint32{2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := ParseReader(strings.NewReader(logLines(test.messages...)), Options{Ip: "1.2.3.4"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			maps := make([]string, 0, len(matches))
+			kills := make([]uint32, 0, len(matches))
+			for _, match := range matches {
+				maps = append(maps, match.Match.Map)
+				kills = append(kills, match.Players[aliceID].Kills)
+			}
+			if !reflect.DeepEqual(maps, test.wantMaps) || !reflect.DeepEqual(kills, test.wantKills) {
+				t.Errorf("got maps %v with kills %v, want %v with %v", maps, kills, test.wantMaps, test.wantKills)
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+	}{
+		{name: "one map", messages: []string{loadMarket, aliceKills, botKills, `Team "#Team_Security" triggered "Round_Win"`,
+			`Team "#Team_Insurgent" triggered "Round_Win"`}},
+		{name: "two maps", messages: []string{loadMarket, aliceKills, `Loading map "sinjar"`, botKills, aliceKills}},
+		{name: "kills before the first map", messages: []string{aliceKills, loadMarket, botKills}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := strings.SplitAfter(logLines(test.messages...), "\n")
+			lines = lines[:len(lines)-1]
+			want, err := ParseReader(strings.NewReader(strings.Join(lines, "")), Options{Ip: "1.2.3.4"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// stop after every line and continue from the state
+			for stop := 1; stop < len(lines); stop++ {
+				p := New(Options{Ip: "1.2.3.4"})
+				for _, line := range lines[:stop] {
+					p.ParseLine(line)
+				}
+				state, err := p.State()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				p, err = Restore(Options{Ip: "1.2.3.4"}, state)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, line := range lines[stop:] {
+					p.ParseLine(line)
+				}
+
+				if got := p.Matches(); !reflect.DeepEqual(got, want) {
+					t.Errorf("stopped after line %d: got %+v, want %+v", stop, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestKillClassification(t *testing.T) {
+	const (
+		alicePrefix = `"Alice<2><STEAM_1:0:12345><#Team_Security>"`
+		bobID       = "STEAM_1:0:67890"
+		killsBob    = alicePrefix + ` killed "Bob<3><STEAM_1:0:67890><#Team_Insurgent>" with "akm<12>" at (1.0, 2.0, 3.0)`
+	)
+	tests := []struct {
+		name string
+		// mode is set with mp_gamemode after the map is loaded unless it's empty
+		mode        string
+		message     string
+		wantPlayers map[string]PlayerStats
+		// wantRound are the players of the round, it's not checked when nil
+		wantRound map[string]RoundPlayerStats
+	}{
+		{
+			name:        "teammate killed",
+			message:     alicePrefix + ` killed "Bob<3><STEAM_1:0:67890><#Team_Security>" with "akm<12>" at (1.0, 2.0, 3.0)`,
+			wantPlayers: map[string]PlayerStats{aliceID: {Name: "Alice", Team: "Security", Fratricide: 1}},
+		},
+		{
+			name:        "killed by own grenade",
+			message:     alicePrefix + ` killed ` + alicePrefix + ` with "grenade_m67<14>" at (1.0, 2.0, 3.0)`,
+			wantPlayers: map[string]PlayerStats{aliceID: {Name: "Alice", Team: "Security", Suicides: 1}},
+		},
+		{
+			name:        "suicide",
+			message:     alicePrefix + ` committed suicide with "grenade_m67"`,
+			wantPlayers: map[string]PlayerStats{aliceID: {Name: "Alice", Suicides: 1}},
+		},
+		{
+			name:        "fall",
+			message:     alicePrefix + ` [10 -20 30] committed suicide with "world"`,
+			wantPlayers: map[string]PlayerStats{aliceID: {Name: "Alice", EnvironmentDeaths: 1}},
+		},
+		{
+			name:        "killed by the map",
+			message:     alicePrefix + ` committed suicide with "trigger_hurt"`,
+			wantPlayers: map[string]PlayerStats{aliceID: {Name: "Alice", EnvironmentDeaths: 1}},
+		},
+		{
+			name:        "bot suicide",
+			message:     `"Bot<5><BOT><#Team_Insurgent>" committed suicide with "world"`,
+			wantPlayers: map[string]PlayerStats{},
+		},
+		{
+			name:    "other team in versus",
+			mode:    "push",
+			message: killsBob,
+			wantPlayers: map[string]PlayerStats{
+				aliceID: {Name: "Alice", Team: "Security", PvPKills: 1},
+				bobID:   {Name: "Bob", Team: "Insurgent", PvPDeaths: 1},
+			},
+			wantRound: map[string]RoundPlayerStats{aliceID: {PvPKills: 1}, bobID: {PvPDeaths: 1}},
+		},
+		{
+			name:        "other team in coop",
+			mode:        "checkpoint",
+			message:     killsBob,
+			wantPlayers: map[string]PlayerStats{aliceID: {Name: "Alice", Team: "Security", Fratricide: 1}},
+			wantRound:   map[string]RoundPlayerStats{},
+		},
+		{
+			name:    "other team without mode",
+			message: killsBob,
+			wantPlayers: map[string]PlayerStats{
+				aliceID: {Name: "Alice", Team: "Security", PvPKills: 1},
+				bobID:   {Name: "Bob", Team: "Insurgent", PvPDeaths: 1},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := []string{loadMarket}
+			if len(test.mode) > 0 {
+				messages = append(messages, `server_cvar: "mp_gamemode" "`+test.mode+`"`)
+			}
+			messages = append(messages, `World triggered "Round_Start"`, test.message)
+
+			matches, err := ParseReader(strings.NewReader(logLines(messages...)), Options{Ip: "1.2.3.4"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) != 1 {
+				t.Fatalf("got %d matches, want 1", len(matches))
+			}
+			if !reflect.DeepEqual(matches[0].Players, test.wantPlayers) {
+				t.Errorf("got players %+v, want %+v", matches[0].Players, test.wantPlayers)
+			}
+			if test.wantRound != nil {
+				if len(matches[0].Rounds) != 1 {
+					t.Fatalf("got %d rounds, want 1", len(matches[0].Rounds))
+				}
+				if round := matches[0].Rounds[0].Players; !reflect.DeepEqual(round, test.wantRound) {
+					t.Errorf("got round players %+v, want %+v", round, test.wantRound)
+				}
+			}
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	const (
+		aliceConnects = `"Alice<2><STEAM_1:0:12345><>" connected, address "192.0.2.1:27005"`
+		aliceEnters   = `"Alice<2><STEAM_1:0:12345><>" entered the game`
+	)
+	tests := []struct {
+		name         string
+		messages     []string
+		wantSessions []Session
+		wantPlaytime uint32
+	}{
+		{
+			name: "disconnected",
+			messages: []string{loadMarket, aliceConnects, aliceEnters,
+				`"Alice<2><STEAM_1:0:12345><#Team_Security>" disconnected (reason "Disconnect")`},
+			wantSessions: []Session{{SteamID: aliceID, Name: "Alice", JoinedAt: startTime + minute,
+				LeftAt: startTime + 3*minute, Reason: "Disconnect"}},
+			wantPlaytime: 2 * minute,
+		},
+		{
+			name: "disconnected without team",
+			messages: []string{loadMarket, aliceConnects,
+				`"Alice<2><STEAM_1:0:12345><>" disconnected (reason "")`},
+			wantSessions: []Session{{SteamID: aliceID, Name: "Alice", JoinedAt: startTime + minute,
+				LeftAt: startTime + 2*minute}},
+			wantPlaytime: minute,
+		},
+		{
+			name:         "still connected",
+			messages:     []string{loadMarket, aliceConnects, aliceEnters},
+			wantSessions: []Session{{SteamID: aliceID, Name: "Alice", JoinedAt: startTime + minute}},
+		},
+		{
+			name:     "server quit",
+			messages: []string{loadMarket, aliceEnters, `server_message: "quit"`},
+			wantSessions: []Session{{SteamID: aliceID, Name: "Alice", JoinedAt: startTime + minute,
+				LeftAt: startTime + 2*minute}},
+			wantPlaytime: minute,
+		},
+		{
+			name:     "next map",
+			messages: []string{loadMarket, aliceEnters, `Loading map "sinjar"`, aliceEnters},
+			wantSessions: []Session{{SteamID: aliceID, Name: "Alice", JoinedAt: startTime + minute,
+				LeftAt: startTime + 2*minute}},
+			wantPlaytime: minute,
+		},
+		{
+			name:         "bot",
+			messages:     []string{loadMarket, `"Bot<5><BOT><>" connected, address "none"`},
+			wantSessions: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := ParseReader(strings.NewReader(logLines(test.messages...)), Options{Ip: "1.2.3.4"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := matches[0]
+			if !reflect.DeepEqual(result.Sessions, test.wantSessions) {
+				t.Errorf("got sessions %+v, want %+v", result.Sessions, test.wantSessions)
+			}
+			if playtime := result.Players[aliceID].Playtime; playtime != test.wantPlaytime {
+				t.Errorf("got playtime %d, want %d", playtime, test.wantPlaytime)
+			}
+		})
+	}
+}
+
+func TestChat(t *testing.T) {
+	const bobSays = `"Bob<3><STEAM_1:1:777><#Team_Insurgent>" say`
+	tests := []struct {
+		name     string
+		message  string
+		wantChat ChatMessage
+	}{
+		{
+			name:     "say",
+			message:  bobSays + ` "hello"`,
+			wantChat: ChatMessage{SteamID: "STEAM_1:1:777", Name: "Bob", Team: "Insurgent", Text: "hello"},
+		},
+		{
+			name:    "say_team",
+			message: `"Bob<3><STEAM_1:1:777><#Team_Insurgent>" say_team "hold"`,
+			wantChat: ChatMessage{SteamID: "STEAM_1:1:777", Name: "Bob", Team: "Insurgent", TeamOnly: true,
+				Text: "hold"},
+		},
+		{
+			name:     "console",
+			message:  `"Console<0><Console><Console>" say "restarting"`,
+			wantChat: ChatMessage{SteamID: "Console", Name: "Console", Team: "Console", Text: "restarting"},
+		},
+		{
+			name:     "looks like a kill",
+			message:  bobSays + ` "` + aliceKills + `"`,
+			wantChat: ChatMessage{SteamID: "STEAM_1:1:777", Name: "Bob", Team: "Insurgent", Text: aliceKills},
+		},
+		{
+			name:    "looks like a map load",
+			message: bobSays + ` "Loading map "sinjar""`,
+			wantChat: ChatMessage{SteamID: "STEAM_1:1:777", Name: "Bob", Team: "Insurgent",
+				Text: `Loading map "sinjar"`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := ParseReader(strings.NewReader(logLines(loadMarket, test.message)), Options{Ip: "1.2.3.4"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(matches) != 1 {
+				t.Fatalf("got %d matches, want 1", len(matches))
+			}
+			result := matches[0]
+			if len(result.Kills) != 0 {
+				t.Errorf("got kills %+v of chat", result.Kills)
+			}
+			want := test.wantChat
+			want.Seq, want.Time = 1, startTime+minute
+			if !reflect.DeepEqual(result.Chat, []ChatMessage{want}) {
+				t.Errorf("got chat %+v, want %+v", result.Chat, want)
+			}
+		})
+	}
+}
+
+func TestObjectives(t *testing.T) {
+	const alicePrefix = `"Alice<2><STEAM_1:0:12345><#Team_Security>" triggered `
+	tests := []struct {
+		name        string
+		message     string
+		wantPlayers map[string]PlayerStats
+	}{
+		{
+			name:        "captured",
+			message:     alicePrefix + `"obj_captured"`,
+			wantPlayers: map[string]PlayerStats{aliceID: {Name: "Alice", Team: "Security", Captures: 1}},
+		},
+		{
+			name:        "cache destroyed",
+			message:     alicePrefix + `"weapon_cache_destroyed"`,
+			wantPlayers: map[string]PlayerStats{aliceID: {Name: "Alice", Team: "Security", CachesDestroyed: 1}},
+		},
+		{
+			name:        "defended",
+			message:     alicePrefix + `"point_defended"`,
+			wantPlayers: map[string]PlayerStats{aliceID: {Name: "Alice", Team: "Security", Defends: 1}},
+		},
+		{
+			name:        "other event",
+			message:     alicePrefix + `"flag_pickup"`,
+			wantPlayers: map[string]PlayerStats{},
+		},
+		{
+			name:        "bot",
+			message:     `"Bot<5><BOT><#Team_Insurgent>" triggered "obj_captured"`,
+			wantPlayers: map[string]PlayerStats{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := ParseReader(strings.NewReader(logLines(loadMarket, test.message)), Options{Ip: "1.2.3.4"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if players := matches[0].Players; !reflect.DeepEqual(players, test.wantPlayers) {
+				t.Errorf("got players %+v, want %+v", players, test.wantPlayers)
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		messages  []string
+		wantNames []PlayerName
+	}{
+		{
+			name:     "seen twice",
+			messages: []string{loadMarket, aliceKills, aliceKills},
+			wantNames: []PlayerName{{SteamID: aliceID, Name: "Alice", FirstSeen: startTime + minute,
+				LastSeen: startTime + 2*minute}},
+		},
+		{
+			name: "changed name",
+			messages: []string{loadMarket, aliceKills,
+				`"Alice<2><STEAM_1:0:12345><#Team_Security>" changed name to "Alicia"`},
+			wantNames: []PlayerName{
+				{SteamID: aliceID, Name: "Alice", FirstSeen: startTime + minute, LastSeen: startTime + 2*minute},
+				{SteamID: aliceID, Name: "Alicia", FirstSeen: startTime + 2*minute, LastSeen: startTime + 2*minute},
+			},
+		},
+		{
+			name: "chat",
+			messages: []string{loadMarket,
+				`"Alice<2><STEAM_1:0:12345><>" say "changed name to "Alicia""`},
+			wantNames: []PlayerName{{SteamID: aliceID, Name: "Alice", FirstSeen: startTime + minute,
+				LastSeen: startTime + minute}},
+		},
+		{
+			name:      "bot",
+			messages:  []string{loadMarket, `"Bot<5><BOT><>" connected, address "none"`},
+			wantNames: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := ParseReader(strings.NewReader(logLines(test.messages...)), Options{Ip: "1.2.3.4"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if names := matches[0].Names; !reflect.DeepEqual(names, test.wantNames) {
+				t.Errorf("got names %+v, want %+v", names, test.wantNames)
+			}
+		})
+	}
+}
+
+func TestTakeChangesWithOtherSteamIDForms(t *testing.T) {
+	const aliceID3Kills = `"Alice<2><[U:1:24690]><#Team_Security>" killed "Bot<5><BOT><#Team_Insurgent>" with "akm<12>" at (1.0, 2.0, 3.0)`
+	p := New(Options{Ip: "1.2.3.4"})
+	lines := strings.SplitAfter(logLines(loadMarket, aliceKills, aliceID3Kills, aliceKills), "\n")
+	for _, line := range lines[:3] {
+		p.ParseLine(line)
+	}
+	p.TakeChanges()
+
+	// only the legacy form changed, the SteamID3 one comes with it
+	p.ParseLine(lines[3])
+	changes := p.TakeChanges()
+	if len(changes) != 1 {
+		t.Fatalf("got %d changed matches, want 1", len(changes))
+	}
+	want := map[string]uint32{aliceID: 2, "[U:1:24690]": 1}
+	got := make(map[string]uint32, len(changes[0].Players))
+	for steamID, stats := range changes[0].Players {
+		got[steamID] = stats.Kills
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got changed players with kills %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,228 @@
+package parser
+
+import (
+	insurgencylog "github.com/j0y/insurgency-log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// steamIDPattern matches STEAM_X:Y:Z, SteamID3 like [U:1:Z], BOT, Console and STEAM_ID_PENDING,
+// the library patterns don't match SteamID3
+const steamIDPattern = `([\w:\[\]]+)`
+
+// playerKillPattern is insurgencylog.PlayerKillPattern with SteamID3
+const playerKillPattern = `"(.+)<(\d+)><` + steamIDPattern + `><#Team_(Security|Insurgent)>" killed "(.+)<(\d+)><` + steamIDPattern + `><#Team_(Security|Insurgent)>" with "(\w+)<(\d+)>" at \((-?\d+.?\d*), (-?\d+.?\d*), (-?\d+.?\d*)\)`
+
+// playerConnectedPattern is insurgencylog.PlayerConnectedPattern with SteamID3
+const playerConnectedPattern = `"(.+)<(\d+)><` + steamIDPattern + `><>" connected, address "(.*)"`
+
+// playerEnteredPattern is insurgencylog.PlayerEnteredPattern with SteamID3
+const playerEnteredPattern = `"(.+)<(\d+)><` + steamIDPattern + `><>" entered the game`
+
+// playerKilledSuicidePattern matches suicides of insurgency teams, the position is not logged by every server
+const playerKilledSuicidePattern = `"(.+)<(\d+)><` + steamIDPattern + `><#Team_(Security|Insurgent)>"(?: \[(-?\d+) (-?\d+) (-?\d+)\])? committed suicide with "(.*)"`
+
+// playerDisconnectedPattern matches disconnects of players in insurgency teams and without team
+const playerDisconnectedPattern = `"(.+)<(\d+)><` + steamIDPattern + `><(?:#Team_)?(\w*)>" disconnected \(reason "(.*)"\)`
+
+// playerSayPattern matches chat of players in insurgency teams, without team and of the server console
+const playerSayPattern = `"(.+)<(\d+)><` + steamIDPattern + `><(?:#Team_)?(\w*)>" say(_team)? "(.*)"`
+
+// playerTriggeredPattern matches events of players in insurgency teams, like obj_captured
+const playerTriggeredPattern = `"(.+)<(\d+)><` + steamIDPattern + `><#Team_(\w+)>" triggered "(\w+)"`
+
+// playerNameChangedPattern matches name changes of players
+const playerNameChangedPattern = `"(.+)<(\d+)><` + steamIDPattern + `><(?:#Team_)?(\w*)>" changed name to "(.*)"`
+
+// gameModePattern matches the game mode set by the server config, like checkpoint or push
+const gameModePattern = `server_cvar: "mp_gamemode" "(\w+)"`
+
+// PlayerTriggered is received when a player triggers an event
+type PlayerTriggered struct {
+	insurgencylog.Meta
+	Player insurgencylog.Player `json:"player"`
+	Event  string               `json:"event"`
+}
+
+// PlayerTriggeredType is the type of PlayerTriggered messages
+const PlayerTriggeredType = "PlayerTriggered"
+
+func NewPlayerTriggered(ti time.Time, r []string) insurgencylog.Message {
+	id, _ := strconv.Atoi(r[2])
+	return PlayerTriggered{
+		Meta: insurgencylog.NewMeta(ti, PlayerTriggeredType),
+		Player: insurgencylog.Player{
+			Name:    r[1],
+			ID:      id,
+			SteamID: r[3],
+			Side:    r[4],
+		},
+		Event: r[5],
+	}
+}
+
+// PlayerNameChanged is received when a player changes the name, Player has the old name
+type PlayerNameChanged struct {
+	insurgencylog.Meta
+	Player  insurgencylog.Player `json:"player"`
+	NewName string               `json:"new_name"`
+}
+
+// PlayerNameChangedType is the type of PlayerNameChanged messages
+const PlayerNameChangedType = "PlayerNameChanged"
+
+func NewPlayerNameChanged(ti time.Time, r []string) insurgencylog.Message {
+	id, _ := strconv.Atoi(r[2])
+	return PlayerNameChanged{
+		Meta: insurgencylog.NewMeta(ti, PlayerNameChangedType),
+		Player: insurgencylog.Player{
+			Name:    r[1],
+			ID:      id,
+			SteamID: r[3],
+			Side:    r[4],
+		},
+		NewName: r[5],
+	}
+}
+
+// GameMode is received when the server sets the game mode, it's kept until the next change
+type GameMode struct {
+	insurgencylog.Meta
+	Mode string `json:"mode"`
+}
+
+// GameModeType is the type of GameMode messages
+const GameModeType = "GameMode"
+
+func NewGameMode(ti time.Time, r []string) insurgencylog.Message {
+	return GameMode{
+		Meta: insurgencylog.NewMeta(ti, GameModeType),
+		Mode: r[1],
+	}
+}
+
+// replacedPatterns are the insurgencylog.DefaultPatterns which are replaced by versions matching SteamID3
+// or players without team, both would match
+var replacedPatterns = map[string]struct{}{
+	insurgencylog.PlayerKillPattern:         {},
+	insurgencylog.PlayerConnectedPattern:    {},
+	insurgencylog.PlayerEnteredPattern:      {},
+	insurgencylog.PlayerDisconnectedPattern: {},
+}
+
+// pattern is a message pattern with the constructor of its message
+type pattern struct {
+	re *regexp.Regexp
+	fn insurgencylog.MessageFunc
+}
+
+// patterns are insurgencylog.DefaultPatterns with insurgency versions of the ones the library only has
+// for other games, versions matching SteamID3 and the ones it misses. They are anchored at the start of
+// the message and tried in order: chat and name changes come first, their text can look like any other
+// message.
+var patterns = func() []pattern {
+	anchored := func(re string) *regexp.Regexp {
+		return regexp.MustCompile("^" + re)
+	}
+	p := []pattern{
+		{anchored(playerSayPattern), insurgencylog.NewPlayerSay},
+		{anchored(playerNameChangedPattern), NewPlayerNameChanged},
+		{anchored(playerKillPattern), insurgencylog.NewPlayerKill},
+		{anchored(playerConnectedPattern), insurgencylog.NewPlayerConnected},
+		{anchored(playerEnteredPattern), insurgencylog.NewPlayerEntered},
+		{anchored(playerKilledSuicidePattern), insurgencylog.NewPlayerKilledSuicide},
+		{anchored(playerDisconnectedPattern), insurgencylog.NewPlayerDisconnected},
+		{anchored(playerTriggeredPattern), NewPlayerTriggered},
+		{anchored(gameModePattern), NewGameMode},
+	}
+
+	// the library patterns in a fixed order, DefaultPatterns is a map
+	var library []pattern
+	for re, fn := range insurgencylog.DefaultPatterns {
+		if _, ok := replacedPatterns[re.String()]; !ok {
+			library = append(library, pattern{anchored(re.String()), fn})
+		}
+	}
+	sort.Slice(library, func(i, j int) bool {
+		return library[i].re.String() < library[j].re.String()
+	})
+
+	return append(p, library...)
+}()
+
+// parseMessage parses a log line with the first of the patterns matching its message
+func parseMessage(line string) (insurgencylog.Message, error) {
+	result := insurgencylog.LogLinePattern.FindStringSubmatch(line)
+	if result == nil {
+		return nil, insurgencylog.ErrorNoMatch
+	}
+
+	ti, err := time.Parse("01/02/2006 - 15:04:05", result[1])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range patterns {
+		if r := p.re.FindStringSubmatch(result[2]); r != nil {
+			return p.fn(ti, r), nil
+		}
+	}
+
+	return insurgencylog.NewUnknown(ti, result[1:]), nil
+}
+
+// objective is what a player did for the objective
+type objective int
+
+const (
+	objectiveCapture objective = iota + 1
+	objectiveCacheDestroyed
+	objectiveDefend
+)
+
+// objectiveEvents are the triggered events counted in the objective stats of players
+var objectiveEvents = map[string]objective{
+	"obj_captured":           objectiveCapture,
+	"point_captured":         objectiveCapture,
+	"obj_destroyed":          objectiveCacheDestroyed,
+	"cache_destroyed":        objectiveCacheDestroyed,
+	"weapon_cache_destroyed": objectiveCacheDestroyed,
+	"obj_defended":           objectiveDefend,
+	"point_defended":         objectiveDefend,
+}
+
+// coopModes are the game modes in which players fight bots together, kills of other players are fratricide in them
+// whatever team the log names. In other modes kills of the other team are PvP kills.
+var coopModes = map[string]struct{}{
+	"checkpoint": {},
+	"hunt":       {},
+	"outpost":    {},
+	"survival":   {},
+	"conquer":    {},
+}
+
+// isCoop reports whether the mode is a coop mode, the mode is empty when the log doesn't set it
+func isCoop(mode string) bool {
+	_, ok := coopModes[mode]
+	return ok
+}
+
+// environmentPrefixes are the prefixes of map entities which kill players, like trigger_hurt
+var environmentPrefixes = []string{"trigger_", "env_", "point_", "func_"}
+
+// isEnvironment reports whether a suicide was a death by falling or by the map and not by the player's own weapon
+func isEnvironment(with string) bool {
+	if with == "world" {
+		return true
+	}
+	for _, prefix := range environmentPrefixes {
+		if strings.HasPrefix(with, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
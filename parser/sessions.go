@@ -0,0 +1,90 @@
+package parser
+
+import "github.com/j0y/insurgency-parser/steamid"
+
+// Session is the time a player spent on the server during a match.
+// A session starts when the player connects or enters the game and ends with the disconnect or the end of the match,
+// players who stay for the next map start a new session when they enter the game again.
+type Session struct {
+	SteamID  string `json:"steam_id"`
+	Name     string `json:"name"`
+	JoinedAt uint64 `json:"joined_at"`
+	// LeftAt is 0 while the player is connected
+	LeftAt uint64 `json:"left_at"`
+	// Reason is the disconnect reason, empty when the match ended first
+	Reason string `json:"reason"`
+}
+
+// Playtime returns the length of the session in seconds, 0 while the player is connected
+func (s Session) Playtime() uint32 {
+	if s.LeftAt < s.JoinedAt {
+		return 0
+	}
+
+	return uint32(s.LeftAt - s.JoinedAt)
+}
+
+// IsSteamID reports whether the id is of a player authenticated with steam, not a bot, the console,
+// STEAM_ID_PENDING or STEAM_ID_LAN
+func IsSteamID(id string) bool {
+	return steamid.IsAccount(id)
+}
+
+// openSession returns the index of the session of the player which is not over yet or -1
+func (m *matchState) openSession(steamID string) int {
+	for i := len(m.result.Sessions) - 1; i >= 0; i-- {
+		session := m.result.Sessions[i]
+		if session.SteamID == steamID && session.LeftAt == 0 {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// joinSession starts a session of the player unless one is open already
+func (m *matchState) joinSession(steamID string, name string, joinedAt uint64) {
+	if !IsSteamID(steamID) || m.openSession(steamID) >= 0 {
+		return
+	}
+
+	m.result.Sessions = append(m.result.Sessions, Session{SteamID: steamID, Name: name, JoinedAt: joinedAt})
+	m.sessionsChanged[len(m.result.Sessions)-1] = struct{}{}
+
+	stats := m.result.Players[steamID]
+	if len(stats.Name) == 0 {
+		stats.Name = name
+		m.result.Players[steamID] = stats
+		m.playersChanged[steamID] = struct{}{}
+	}
+}
+
+// leaveSession ends the open session of the player and adds it to the player playtime
+func (m *matchState) leaveSession(steamID string, leftAt uint64, reason string) {
+	i := m.openSession(steamID)
+	if i < 0 {
+		return
+	}
+
+	session := &m.result.Sessions[i]
+	session.LeftAt = leftAt
+	session.Reason = reason
+	m.sessionsChanged[i] = struct{}{}
+
+	stats := m.result.Players[steamID]
+	if len(stats.Name) == 0 {
+		stats.Name = session.Name
+	}
+	stats.Playtime += session.Playtime()
+	m.result.Players[steamID] = stats
+	m.playersChanged[steamID] = struct{}{}
+}
+
+// endSessions ends the sessions of every player still connected when the match is over
+func (m *matchState) endSessions(endedAt uint64) {
+	for _, session := range m.result.Sessions {
+		if session.LeftAt == 0 {
+			m.leaveSession(session.SteamID, endedAt, "")
+		}
+	}
+}
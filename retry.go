@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	retryAttempts = 5
+	// retryDelay is the wait after the first failure, it doubles after every next one
+	retryDelay = time.Second
+)
+
+// permanentError is an error which happens again every time the same file is parsed,
+// like a file name without ip or a malformed SteamID, so retrying doesn't help
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// retry runs op until it succeeds, returns a permanent error or fails retryAttempts times,
+// the failures are expected to be transient database or network errors
+func retry(ctx context.Context, name string, op func() error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || isPermanent(err) || ctx.Err() != nil || attempt == retryAttempts {
+			return err
+		}
+
+		log.Printf("%s failed, retrying in %s: %v\n", name, delay, err)
+		if !sleep(ctx, delay) {
+			return err
+		}
+		delay *= 2
+	}
+}
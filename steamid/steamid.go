@@ -0,0 +1,76 @@
+// Package steamid converts the SteamID formats servers log to SteamID64, which identifies users
+package steamid
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// base is the SteamID64 of account 0, the SteamID64 of an individual account is base plus its account id
+const base = 76561197960265728
+
+// ErrNoAccount is returned for players without a steam account, like bots, the console,
+// STEAM_ID_PENDING before the player is authenticated and STEAM_ID_LAN on LAN servers
+var ErrNoAccount = errors.New("no steam account")
+
+var (
+	// legacyRe matches STEAM_X:Y:Z, the account id is Z*2+Y
+	legacyRe = regexp.MustCompile(`^STEAM_[0-5]:([01]):(\d+)$`)
+	// steamID3Re matches [U:1:account id] of individual accounts
+	steamID3Re  = regexp.MustCompile(`^\[U:1:(\d+)\]$`)
+	steamID64Re = regexp.MustCompile(`^\d{17}$`)
+)
+
+// noAccount are the ids servers log for players without a steam account
+var noAccount = map[string]struct{}{
+	"BOT":              {},
+	"Console":          {},
+	"STEAM_ID_PENDING": {},
+	"STEAM_ID_LAN":     {},
+	"UNKNOWN":          {},
+	"":                 {},
+}
+
+// Parse returns the SteamID64 of STEAM_X:Y:Z, [U:1:Z] and SteamID64 ids of individual accounts,
+// ErrNoAccount for players without an account and an error for anything else
+func Parse(id string) (int64, error) {
+	if _, ok := noAccount[id]; ok {
+		return 0, ErrNoAccount
+	}
+
+	var accountID uint64
+	var err error
+	if r := legacyRe.FindStringSubmatch(id); r != nil {
+		accountID, err = strconv.ParseUint(r[2], 10, 31)
+		if err == nil {
+			accountID = accountID*2 + uint64(r[1][0]-'0')
+		}
+	} else if r := steamID3Re.FindStringSubmatch(id); r != nil {
+		accountID, err = strconv.ParseUint(r[1], 10, 32)
+	} else if steamID64Re.MatchString(id) {
+		var steamID64 uint64
+		steamID64, err = strconv.ParseUint(id, 10, 64)
+		if err == nil && (steamID64 < base || steamID64-base >= 1<<32) {
+			return 0, fmt.Errorf("%s is not a SteamID64 of an individual account", id)
+		}
+		accountID = steamID64 - base
+	} else {
+		return 0, fmt.Errorf("unknown SteamID format: %s", id)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("SteamID %s: %w", id, err)
+	}
+	if accountID == 0 {
+		return 0, ErrNoAccount
+	}
+
+	return int64(base + accountID), nil
+}
+
+// IsAccount reports whether the id is of a player with a steam account
+func IsAccount(id string) bool {
+	_, err := Parse(id)
+	return err == nil
+}
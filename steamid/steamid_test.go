@@ -0,0 +1,64 @@
+package steamid
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		want    int64
+		wantErr error
+	}{
+		{name: "STEAM_0", id: "STEAM_0:0:12345", want: 76561197960290418},
+		{name: "STEAM_1", id: "STEAM_1:0:12345", want: 76561197960290418},
+		{name: "odd account", id: "STEAM_1:1:12345", want: 76561197960290419},
+		{name: "SteamID3", id: "[U:1:24690]", want: 76561197960290418},
+		{name: "SteamID64", id: "76561197960290418", want: 76561197960290418},
+		{name: "pending", id: "STEAM_ID_PENDING", wantErr: ErrNoAccount},
+		{name: "LAN", id: "STEAM_ID_LAN", wantErr: ErrNoAccount},
+		{name: "bot", id: "BOT", wantErr: ErrNoAccount},
+		{name: "console", id: "Console", wantErr: ErrNoAccount},
+		{name: "account 0", id: "STEAM_1:0:0", wantErr: ErrNoAccount},
+		{name: "SteamID3 account 0", id: "[U:1:0]", wantErr: ErrNoAccount},
+		{name: "SteamID64 account 0", id: "76561197960265728", wantErr: ErrNoAccount},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse(test.id)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{name: "Y other than 0 or 1", id: "STEAM_1:2:12345"},
+		{name: "account id overflow", id: "STEAM_1:0:2147483648"},
+		{name: "SteamID3 overflow", id: "[U:1:4294967296]"},
+		{name: "SteamID3 of a group", id: "[g:1:12345]"},
+		{name: "SteamID64 overflow", id: "99999999999999999"},
+		{name: "SteamID64 below account 0", id: "76561197960265727"},
+		{name: "not a SteamID", id: "Alice"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse(test.id)
+			if err == nil || errors.Is(err, ErrNoAccount) {
+				t.Errorf("got %d and error %v, want an error of the malformed id", got, err)
+			}
+		})
+	}
+}